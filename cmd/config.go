@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"clawproxy/internal/server"
+	"clawproxy/internal/workerpool"
+)
+
+// fileConfig is the JSON file passed with --config. Settings that only make
+// sense as lists of structured values live here rather than in flags.
+type fileConfig struct {
+	Listeners []server.ListenerConfig `json:"listeners,omitempty"`
+	Tenants   []server.TenantConfig   `json:"tenants,omitempty"`
+	Webhooks  server.WebhookConfig    `json:"webhooks,omitempty"`
+	// Options lists the request options clients may send.
+	Options map[string]server.OptionRule `json:"options,omitempty"`
+	// Timeouts adds per-device and per-scope timeouts to the flag defaults.
+	Timeouts server.TimeoutConfig `json:"timeouts,omitempty"`
+	executorConfig
+	// Record captures the executor's runs to a cassette for replay.
+	Record *server.RecordConfig `json:"record,omitempty"`
+	// Retry and Circuit wrap the executor, in that order; Fallback takes
+	// over when the wrapped executor fails.
+	Retry    *server.RetryConfig   `json:"retry,omitempty"`
+	Circuit  *server.CircuitConfig `json:"circuit,omitempty"`
+	Fallback *executorConfig       `json:"fallback,omitempty"`
+}
+
+// executorConfig selects how messages run. The first one set wins, in the
+// order replay, workers, http, command.
+type executorConfig struct {
+	// Replay answers from a recorded cassette without running openclaw.
+	Replay *server.ReplayConfig `json:"replay,omitempty"`
+	// Command replaces the built-in openclaw invocation.
+	Command *server.TemplateExecutor `json:"command,omitempty"`
+	// HTTP forwards messages to remote openclaw gateways instead.
+	HTTP *server.HTTPExecutorConfig `json:"http,omitempty"`
+	// Workers replaces it with a pool of warm openclaw workers.
+	Workers *workerpool.Config `json:"workers,omitempty"`
+}
+
+// build returns the configured executor, or def when none is set, and a
+// function releasing what it started. name labels its metrics.
+func (c executorConfig) build(name string, def server.CommandExecutor) (server.CommandExecutor, func(), error) {
+	switch {
+	case c.Replay != nil:
+		executor, err := server.NewReplayExecutor(*c.Replay)
+		if err != nil {
+			return nil, nil, err
+		}
+		return executor, func() {}, nil
+	case c.Workers != nil:
+		pool, err := workerpool.New(*c.Workers)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := pool.Start(); err != nil {
+			return nil, nil, fmt.Errorf("start workers: %w", err)
+		}
+		return server.WorkerExecutor{Name: name, Pool: pool}, func() { pool.Close() }, nil
+	case c.HTTP != nil:
+		executor, err := server.NewHTTPExecutor(*c.HTTP)
+		if err != nil {
+			return nil, nil, err
+		}
+		return executor, func() {}, nil
+	case c.Command != nil:
+		return *c.Command, func() {}, nil
+	default:
+		return def, func() {}, nil
+	}
+}
+
+// executor builds the executor chain: the primary executor, wrapped by the
+// recorder, retry, circuit breaker and fallback when configured.
+func (c *fileConfig) executor(def server.CommandExecutor) (server.CommandExecutor, func(), error) {
+	executor, closePrimary, err := c.executorConfig.build("primary", def)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Record != nil {
+		recorder, err := server.NewRecordingExecutor(executor, *c.Record)
+		if err != nil {
+			closePrimary()
+			return nil, nil, err
+		}
+		closeExecutor := closePrimary
+		executor = recorder
+		closePrimary = func() {
+			if err := recorder.Close(); err != nil {
+				log.Printf("[server] close cassette failed err=%v", err)
+			}
+			closeExecutor()
+		}
+	}
+	if c.Retry != nil {
+		if err := c.Retry.Validate(); err != nil {
+			closePrimary()
+			return nil, nil, err
+		}
+		executor = server.RetryExecutor{Next: executor, Config: *c.Retry}
+	}
+	if c.Circuit != nil {
+		if err := c.Circuit.Validate(); err != nil {
+			closePrimary()
+			return nil, nil, err
+		}
+		executor = server.NewCircuitBreaker("primary", executor, *c.Circuit)
+	}
+	if c.Fallback == nil {
+		return executor, closePrimary, nil
+	}
+
+	fallback, closeFallback, err := c.Fallback.build("fallback", nil)
+	if err == nil && fallback == nil {
+		err = fmt.Errorf("fallback: replay, workers, http or command is required")
+	}
+	if err != nil {
+		closePrimary()
+		return nil, nil, err
+	}
+
+	return server.FallbackExecutor{Primary: executor, Fallback: fallback}, func() {
+		closePrimary()
+		closeFallback()
+	}, nil
+}
+
+// timeoutConfig applies the file's timeouts over the flag values, except
+// where the flag was set on the command line: flags win, as everywhere else.
+func (c *fileConfig) timeoutConfig(flags server.TimeoutConfig, changed func(flag string) bool) server.TimeoutConfig {
+	file := c.Timeouts
+	if changed("timeout-seconds") {
+		file.DefaultSeconds = 0
+	}
+	if changed("kill-grace-seconds") {
+		file.GraceSeconds = 0
+	}
+
+	return flags.Override(file)
+}
+
+func loadConfig(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/spf13/cobra"
+)
+
+var pairServerURL string
+
+var pairCmd = &cobra.Command{
+	Use:   "pair",
+	Short: "Manage device pairing codes on a running clawproxy server",
+}
+
+var pairCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a one-time pairing code for a device",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		deviceID, err := cmd.Flags().GetString("device-id")
+		if err != nil {
+			return fmt.Errorf("get device-id flag: %w", err)
+		}
+
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			return fmt.Errorf("get ttl flag: %w", err)
+		}
+
+		scopes, err := cmd.Flags().GetStringSlice("scope")
+		if err != nil {
+			return fmt.Errorf("get scope flag: %w", err)
+		}
+
+		expiresInRaw, err := cmd.Flags().GetString("token-expires-in")
+		if err != nil {
+			return fmt.Errorf("get token-expires-in flag: %w", err)
+		}
+		expiresIn, err := parseExpiresInDays(expiresInRaw)
+		if err != nil {
+			return err
+		}
+
+		body := map[string]any{
+			"deviceId":              deviceID,
+			"scopes":                scopes,
+			"ttlSeconds":            int64(ttl.Seconds()),
+			"tokenExpiresInSeconds": int64(expiresIn.Seconds()),
+		}
+		var resp struct {
+			ID        string    `json:"id"`
+			Code      string    `json:"code"`
+			ExpiresAt time.Time `json:"expiresAt"`
+		}
+		if err := callAdminAPI(http.MethodPost, "/v1/admin/pairings", body, &resp); err != nil {
+			return err
+		}
+
+		cmd.Printf("code: %s\nid: %s\nexpires at: %s\n", resp.Code, resp.ID, resp.ExpiresAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var pairListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List pending and consumed pairings",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var resp struct {
+			Pairings []struct {
+				ID        string    `json:"id"`
+				Code      string    `json:"code"`
+				DeviceID  string    `json:"deviceId"`
+				Status    string    `json:"status"`
+				ExpiresAt time.Time `json:"expiresAt"`
+			} `json:"pairings"`
+		}
+		if err := callAdminAPI(http.MethodGet, "/v1/admin/pairings", nil, &resp); err != nil {
+			return err
+		}
+
+		for _, p := range resp.Pairings {
+			cmd.Printf("%s\t%s\t%s\t%s\t%s\n", p.ID, p.Code, p.DeviceID, p.Status, p.ExpiresAt.Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+var pairRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke a pairing and any token issued from it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := callAdminAPI(http.MethodDelete, "/v1/admin/pairings/"+args[0], nil, nil); err != nil {
+			return err
+		}
+
+		cmd.Printf("revoked: %s\n", args[0])
+		return nil
+	},
+}
+
+// callAdminAPI signs a short-lived admin token with the shared secret and calls the server.
+func callAdminAPI(method, path string, body, out any) error {
+	token, err := auth.GenerateToken([]byte(jwtSecret), "clawproxy-cli", time.Minute, auth.ScopeAdmin)
+	if err != nil {
+		return fmt.Errorf("generate admin token: %w", err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request body: %w", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(pairServerURL, "/")+path, reader)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("call %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s failed: status=%d body=%s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+func init() {
+	pairCmd.PersistentFlags().StringVar(&pairServerURL, "server", "http://127.0.0.1:8080", "base URL of the running clawproxy server")
+
+	pairCreateCmd.Flags().String("device-id", "", "device/session id the paired token is issued for")
+	pairCreateCmd.Flags().Duration("ttl", 10*time.Minute, "how long the pairing code stays valid")
+	pairCreateCmd.Flags().StringSlice("scope", nil, "scopes of the issued token; empty means chat only")
+	pairCreateCmd.Flags().String("token-expires-in", "", "issued token expiration in days, e.g. 30d; empty means never expires")
+	_ = pairCreateCmd.MarkFlagRequired("device-id")
+
+	pairCmd.AddCommand(pairCreateCmd, pairListCmd, pairRevokeCmd)
+	rootCmd.AddCommand(pairCmd)
+}
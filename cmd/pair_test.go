@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clawproxy/internal/server"
+)
+
+func TestPairCreateCommand(t *testing.T) {
+	srv := server.New(":0", "test-secret")
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	buf := &bytes.Buffer{}
+	rootCmd.SetOut(buf)
+	rootCmd.SetErr(buf)
+	rootCmd.SetArgs([]string{"--jwt-secret", "test-secret", "pair", "create", "--server", ts.URL, "--device-id", "dev-1", "--ttl", "5m"})
+
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("execute pair create: %v", err)
+	}
+	if !strings.Contains(buf.String(), "code: ") {
+		t.Fatalf("expected pairing code in output: %s", buf.String())
+	}
+
+	buf.Reset()
+	rootCmd.SetArgs([]string{"--jwt-secret", "test-secret", "pair", "list", "--server", ts.URL})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("execute pair list: %v", err)
+	}
+	if !strings.Contains(buf.String(), "dev-1\tpending") {
+		t.Fatalf("expected pending pairing in list output: %s", buf.String())
+	}
+}
@@ -7,20 +7,87 @@ import (
 	"time"
 
 	"clawproxy/internal/auth"
+	"clawproxy/internal/pairing"
+	"clawproxy/internal/ratelimit"
 	"clawproxy/internal/server"
 	"github.com/spf13/cobra"
 )
 
 var (
-	addr      string
-	jwtSecret string
+	addr           string
+	jwtSecret      string
+	allowedOrigins []string
+	allowAnyOrigin bool
+	pairingStore   string
+	configPath     string
+	listener       server.ListenerConfig
+	allowCIDRs     []string
+	denyCIDRs      []string
+	lockout        = server.DefaultLockoutConfig
+	limits         ratelimit.Limits
+	trustedProxies []string
+	openclaw       server.OpenClawExecutor
+	timeouts       server.TimeoutConfig
+	idempotencyTTL time.Duration
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "clawproxy",
 	Short: "WebSocket proxy for openclaw agent command execution",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return server.New(addr, jwtSecret).Run()
+		origins, err := server.NewOriginAllowlist(allowedOrigins, allowAnyOrigin)
+		if err != nil {
+			return fmt.Errorf("parse allowed origins: %w", err)
+		}
+
+		pairings, err := pairing.NewStore(pairingStore)
+		if err != nil {
+			return fmt.Errorf("open pairing store: %w", err)
+		}
+
+		ipFilter, err := server.NewIPFilter(allowCIDRs, denyCIDRs)
+		if err != nil {
+			return fmt.Errorf("parse cidr lists: %w", err)
+		}
+
+		proxies, err := server.ParseCIDRs(trustedProxies)
+		if err != nil {
+			return fmt.Errorf("parse trusted proxies: %w", err)
+		}
+
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			return err
+		}
+
+		listeners := cfg.Listeners
+		if len(listeners) == 0 {
+			listener.Addr = addr
+			listeners = []server.ListenerConfig{listener}
+		}
+
+		opts := []server.Option{
+			server.WithOriginAllowlist(origins),
+			server.WithPairingStore(pairings),
+			server.WithListeners(listeners...),
+			server.WithIPFilter(ipFilter),
+			server.WithLockout(lockout),
+			server.WithLimits(limits),
+			server.WithTrustedProxies(proxies),
+			server.WithTenants(cfg.Tenants...),
+			server.WithWebhooks(cfg.Webhooks),
+			server.WithOptions(cfg.Options),
+			server.WithTimeouts(cfg.timeoutConfig(timeouts, cmd.Flags().Changed)),
+			server.WithIdempotencyTTL(idempotencyTTL),
+		}
+		executor, closeExecutor, err := cfg.executor(openclaw)
+		if err != nil {
+			return err
+		}
+		defer closeExecutor()
+		opts = append(opts, server.WithExecutor(executor))
+
+		return server.New(addr, jwtSecret, opts...).Run()
 	},
 }
 
@@ -43,7 +110,32 @@ var tokenCmd = &cobra.Command{
 			return err
 		}
 
-		tokenString, err := auth.GenerateToken([]byte(jwtSecret), deviceID, expiresIn)
+		scopes, err := cmd.Flags().GetStringSlice("scope")
+		if err != nil {
+			return fmt.Errorf("get scope flag: %w", err)
+		}
+
+		tenant, err := cmd.Flags().GetString("tenant")
+		if err != nil {
+			return fmt.Errorf("get tenant flag: %w", err)
+		}
+
+		claims := auth.Claims{Subject: deviceID, Scope: strings.Join(scopes, " "), Tenant: tenant}
+		if expiresIn > 0 {
+			expiresAt := time.Now().Add(expiresIn).Unix()
+			claims.ExpiresAt = &expiresAt
+		}
+		if claims.RatePerMinute, err = cmd.Flags().GetFloat64("rate-per-minute"); err != nil {
+			return fmt.Errorf("get rate-per-minute flag: %w", err)
+		}
+		if claims.RateBurst, err = cmd.Flags().GetInt("rate-burst"); err != nil {
+			return fmt.Errorf("get rate-burst flag: %w", err)
+		}
+		if claims.DailyQuota, err = cmd.Flags().GetInt("daily-quota"); err != nil {
+			return fmt.Errorf("get daily-quota flag: %w", err)
+		}
+
+		tokenString, err := auth.SignToken([]byte(jwtSecret), claims)
 		if err != nil {
 			return fmt.Errorf("generate jwt token: %w", err)
 		}
@@ -73,10 +165,38 @@ func parseExpiresInDays(raw string) (time.Duration, error) {
 
 func init() {
 	rootCmd.Flags().StringVar(&addr, "addr", ":8080", "HTTP listen address")
+	rootCmd.Flags().StringSliceVar(&allowedOrigins, "allowed-origins", nil, "browser origins allowed to open /ws, e.g. https://app.example.com,https://*.example.com")
+	rootCmd.Flags().BoolVar(&allowAnyOrigin, "allow-any-origin", false, "skip the origin check on /ws, for deployments with only native clients")
+	rootCmd.Flags().StringVar(&pairingStore, "pairing-store", "", "JSON file persisting device pairings and revocations; empty keeps them in memory")
+	rootCmd.Flags().StringVar(&configPath, "config", "", "JSON config file; listeners defined there replace the --addr/--tls-* listener")
+	rootCmd.Flags().StringVar(&listener.TLSCert, "tls-cert", "", "TLS certificate file; enables HTTPS/WSS on --addr")
+	rootCmd.Flags().StringVar(&listener.TLSKey, "tls-key", "", "TLS private key file")
+	rootCmd.Flags().StringVar(&listener.ClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates")
+	rootCmd.Flags().StringVar((*string)(&listener.AuthMode), "auth-mode", string(server.AuthModeJWT), "client authentication: jwt, mtls, either or both")
+	rootCmd.Flags().StringVar(&listener.CertIdentity, "cert-identity", server.CertIdentityCN, "client certificate field used as deviceId: cn, dns, uri or email")
+	rootCmd.Flags().StringSliceVar(&listener.CertScopes, "cert-scope", nil, "scopes granted to certificate-only clients; empty means chat only")
+	rootCmd.Flags().StringSliceVar(&allowCIDRs, "allow-cidr", nil, "client CIDRs allowed to open /ws; empty allows all that are not denied")
+	rootCmd.Flags().StringSliceVar(&denyCIDRs, "deny-cidr", nil, "client CIDRs never allowed to open /ws")
+	rootCmd.Flags().IntVar(&lockout.Threshold, "lockout-threshold", lockout.Threshold, "failed authentications per IP or deviceId before lockout; 0 disables lockouts")
+	rootCmd.Flags().DurationVar(&lockout.BaseDelay, "lockout-base", lockout.BaseDelay, "first lockout duration, doubled on each further failure")
+	rootCmd.Flags().DurationVar(&lockout.MaxDelay, "lockout-max", lockout.MaxDelay, "maximum lockout duration")
+	rootCmd.Flags().Float64Var(&limits.PerMinute, "rate-per-minute", 0, "default messages per minute per deviceId; 0 means unlimited")
+	rootCmd.Flags().IntVar(&limits.Burst, "rate-burst", 0, "default burst size per deviceId; 0 means the per-minute rate")
+	rootCmd.Flags().IntVar(&limits.DailyQuota, "daily-quota", 0, "default messages per day per deviceId (UTC); 0 means unlimited")
+	rootCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "reverse proxy CIDRs whose X-Forwarded-For/X-Real-IP and PROXY headers are trusted; empty trusts none")
+	rootCmd.Flags().BoolVar(&listener.ProxyProtocol, "proxy-protocol", false, "require a PROXY protocol v1/v2 header on every connection to --addr; needs --trusted-proxies")
+	rootCmd.Flags().IntVar(&timeouts.DefaultSeconds, "timeout-seconds", 300, "default time a message may run before it fails with TIMEOUT")
+	rootCmd.Flags().IntVar(&timeouts.GraceSeconds, "kill-grace-seconds", 5, "time a timed-out command has to exit after SIGTERM before SIGKILL")
+	rootCmd.Flags().DurationVar(&idempotencyTTL, "idempotency-ttl", 10*time.Minute, "how long replies to messages with an idempotencyKey are remembered")
 	rootCmd.PersistentFlags().StringVar(&jwtSecret, "jwt-secret", "clawproxy-dev-secret", "JWT shared secret for token verification and generation")
 
 	tokenCmd.Flags().String("device-id", "", "device/session id used as JWT sub claim")
 	tokenCmd.Flags().String("expires-in", "", "token expiration in days, e.g. 1d; empty means never expires")
+	tokenCmd.Flags().StringSlice("scope", nil, "token scopes: chat, history:read, admin, push; empty means chat only")
+	tokenCmd.Flags().Float64("rate-per-minute", 0, "per-token messages per minute, overriding the server default")
+	tokenCmd.Flags().Int("rate-burst", 0, "per-token burst size, overriding the server default")
+	tokenCmd.Flags().Int("daily-quota", 0, "per-token daily message quota, overriding the server default")
+	tokenCmd.Flags().String("tenant", "", "tenant id; sign with one of that tenant's secrets via --jwt-secret")
 	_ = tokenCmd.MarkFlagRequired("device-id")
 	rootCmd.AddCommand(tokenCmd)
 }
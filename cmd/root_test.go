@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"clawproxy/internal/auth"
+	"clawproxy/internal/server"
 )
 
 func TestTokenCommand(t *testing.T) {
@@ -49,6 +50,25 @@ func TestTokenCommand_DefaultNoExpire(t *testing.T) {
 	}
 }
 
+func TestTokenCommand_Scope(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rootCmd.SetOut(buf)
+	rootCmd.SetErr(buf)
+	rootCmd.SetArgs([]string{"--jwt-secret", "test-secret", "token", "--device-id", "dev-1", "--scope", "chat,history:read"})
+
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("execute root command: %v", err)
+	}
+
+	claims, err := auth.ParseToken([]byte("test-secret"), string(bytes.TrimSpace(buf.Bytes())))
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Scope != "chat history:read" {
+		t.Fatalf("unexpected scope claim: %q", claims.Scope)
+	}
+}
+
 func TestParseExpiresInDays(t *testing.T) {
 	d, err := parseExpiresInDays("1d")
 	if err != nil {
@@ -62,3 +82,16 @@ func TestParseExpiresInDays(t *testing.T) {
 		t.Fatalf("expected parse error for invalid format")
 	}
 }
+
+func TestTimeoutConfig_FlagsWinOverFile(t *testing.T) {
+	cfg := &fileConfig{Timeouts: server.TimeoutConfig{DefaultSeconds: 600, GraceSeconds: 9, Devices: map[string]int{"dev-1": 30}}}
+	flags := server.TimeoutConfig{DefaultSeconds: 60, GraceSeconds: 5}
+
+	got := cfg.timeoutConfig(flags, func(flag string) bool { return flag == "timeout-seconds" })
+	if got.DefaultSeconds != 60 || got.GraceSeconds != 9 || got.Devices["dev-1"] != 30 {
+		t.Fatalf("expected the flag's default and the file's grace and devices, got %+v", got)
+	}
+	if got := cfg.timeoutConfig(flags, func(string) bool { return false }); got.DefaultSeconds != 600 {
+		t.Fatalf("expected the file to override unset flags, got %+v", got)
+	}
+}
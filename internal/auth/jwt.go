@@ -5,25 +5,71 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
-type claims struct {
+var ErrTokenExpired = errors.New("jwt token expired")
+
+type Claims struct {
+	ID        string `json:"jti,omitempty"`
 	Subject   string `json:"sub"`
 	IssuedAt  int64  `json:"iat"`
 	ExpiresAt *int64 `json:"exp,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	// Tenant selects the tenant whose keys, limits and openclaw profile apply.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Optional per-token limits overriding the server defaults.
+	RatePerMinute float64 `json:"rate_per_minute,omitempty"`
+	RateBurst     int     `json:"rate_burst,omitempty"`
+	DailyQuota    int     `json:"daily_quota,omitempty"`
 }
 
-func GenerateToken(secret []byte, subject string, expiresIn time.Duration) (string, error) {
-	now := time.Now().Unix()
-	jwtClaims := claims{Subject: subject, IssuedAt: now}
+// Expiry returns the token expiration time, or the zero time when the token never expires.
+func (c *Claims) Expiry() time.Time {
+	if c.ExpiresAt == nil {
+		return time.Time{}
+	}
+
+	return time.Unix(*c.ExpiresAt, 0)
+}
+
+func GenerateToken(secret []byte, subject string, expiresIn time.Duration, scopes ...string) (string, error) {
+	jwtClaims := Claims{Subject: subject, IssuedAt: time.Now().Unix(), Scope: strings.Join(scopes, " ")}
 	if expiresIn > 0 {
-		expiresAt := now + int64(expiresIn.Seconds())
+		expiresAt := jwtClaims.IssuedAt + int64(expiresIn.Seconds())
 		jwtClaims.ExpiresAt = &expiresAt
 	}
 
+	return SignToken(secret, jwtClaims)
+}
+
+// ValidateDeviceID rejects deviceIds that could be mistaken for another
+// tenant's: tenant sessions are named "tenant:deviceId", so default-tenant
+// deviceIds must not contain a colon.
+func ValidateDeviceID(tenant, deviceID string) error {
+	if tenant == "" && strings.Contains(deviceID, ":") {
+		return fmt.Errorf("deviceId %q must not contain ':'", deviceID)
+	}
+
+	return nil
+}
+
+// SignToken signs the given claims. IssuedAt defaults to now when unset.
+func SignToken(secret []byte, jwtClaims Claims) (string, error) {
+	if err := ValidateScopes(strings.Fields(jwtClaims.Scope)); err != nil {
+		return "", err
+	}
+	if err := ValidateDeviceID(jwtClaims.Tenant, jwtClaims.Subject); err != nil {
+		return "", err
+	}
+	if jwtClaims.IssuedAt == 0 {
+		jwtClaims.IssuedAt = time.Now().Unix()
+	}
+
 	payload, err := json.Marshal(jwtClaims)
 	if err != nil {
 		return "", fmt.Errorf("marshal jwt payload: %w", err)
@@ -44,45 +90,75 @@ func GenerateToken(secret []byte, subject string, expiresIn time.Duration) (stri
 }
 
 func ValidateToken(secret []byte, token string) error {
+	_, err := ParseToken(secret, token)
+	return err
+}
+
+// ParseToken verifies the token signature and expiration and returns its claims.
+func ParseToken(secret []byte, token string) (*Claims, error) {
+	return ParseTokenWithKeys(token, func(*Claims) ([][]byte, error) {
+		return [][]byte{secret}, nil
+	})
+}
+
+// KeyFunc returns the secrets a token may be signed with. It receives the
+// unverified claims, so it must only use them to select keys.
+type KeyFunc func(unverified *Claims) ([][]byte, error)
+
+// ParseTokenWithKeys verifies the token against the secrets chosen by keys,
+// accepting any of them, then checks expiration.
+func ParseTokenWithKeys(token string, keys KeyFunc) (*Claims, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return fmt.Errorf("invalid jwt format")
+		return nil, fmt.Errorf("invalid jwt format")
 	}
 
 	headerRaw, err := base64.RawURLEncoding.DecodeString(parts[0])
 	if err != nil {
-		return fmt.Errorf("decode jwt header: %w", err)
+		return nil, fmt.Errorf("decode jwt header: %w", err)
 	}
 	if string(headerRaw) != `{"alg":"HS256","typ":"JWT"}` {
-		return fmt.Errorf("unsupported jwt header")
+		return nil, fmt.Errorf("unsupported jwt header")
 	}
 
-	mac := hmac.New(sha256.New, secret)
-	if _, err := mac.Write([]byte(parts[0] + "." + parts[1])); err != nil {
-		return fmt.Errorf("calculate signature: %w", err)
-	}
-	expectedSig := mac.Sum(nil)
-	actualSig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	payloadRaw, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return fmt.Errorf("decode jwt signature: %w", err)
+		return nil, fmt.Errorf("decode jwt payload: %w", err)
+	}
+
+	var c Claims
+	if err := json.Unmarshal(payloadRaw, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal jwt payload: %w", err)
 	}
-	if !hmac.Equal(actualSig, expectedSig) {
-		return fmt.Errorf("jwt signature mismatch")
+
+	secrets, err := keys(&c)
+	if err != nil {
+		return nil, err
 	}
 
-	payloadRaw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	actualSig, err := base64.RawURLEncoding.DecodeString(parts[2])
 	if err != nil {
-		return fmt.Errorf("decode jwt payload: %w", err)
+		return nil, fmt.Errorf("decode jwt signature: %w", err)
 	}
 
-	var c claims
-	if err := json.Unmarshal(payloadRaw, &c); err != nil {
-		return fmt.Errorf("unmarshal jwt payload: %w", err)
+	verified := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		if _, err := mac.Write([]byte(parts[0] + "." + parts[1])); err != nil {
+			return nil, fmt.Errorf("calculate signature: %w", err)
+		}
+		if hmac.Equal(actualSig, mac.Sum(nil)) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("jwt signature mismatch")
 	}
 
 	if c.ExpiresAt != nil && *c.ExpiresAt <= time.Now().Unix() {
-		return fmt.Errorf("jwt token expired")
+		return nil, ErrTokenExpired
 	}
 
-	return nil
+	return &c, nil
 }
@@ -51,3 +51,29 @@ func TestGenerateTokenWithoutExpiration(t *testing.T) {
 		t.Fatalf("validate token without exp: %v", err)
 	}
 }
+
+func TestParseTokenWithKeys_SelectsByTenant(t *testing.T) {
+	token, err := SignToken([]byte("tenant-b-new"), Claims{Subject: "dev-1", Tenant: "b"})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	keys := func(c *Claims) ([][]byte, error) {
+		if c.Tenant == "b" {
+			return [][]byte{[]byte("tenant-b-old"), []byte("tenant-b-new")}, nil
+		}
+		return [][]byte{[]byte("default")}, nil
+	}
+
+	claims, err := ParseTokenWithKeys(token, keys)
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Tenant != "b" {
+		t.Fatalf("unexpected tenant: %q", claims.Tenant)
+	}
+
+	if _, err := ParseToken([]byte("default"), token); err == nil {
+		t.Fatal("expected default secret to reject tenant token")
+	}
+}
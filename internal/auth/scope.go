@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ScopeChat        = "chat"
+	ScopeHistoryRead = "history:read"
+	ScopeAdmin       = "admin"
+	ScopePush        = "push"
+)
+
+var knownScopes = map[string]bool{
+	ScopeChat:        true,
+	ScopeHistoryRead: true,
+	ScopeAdmin:       true,
+	ScopePush:        true,
+}
+
+// DefaultScopes are granted to tokens issued without a scope claim, which
+// keeps tokens minted before scopes existed working for chat.
+var DefaultScopes = []string{ScopeChat}
+
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !knownScopes[scope] {
+			return fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// Scopes returns the scopes granted by the token.
+func (c *Claims) Scopes() []string {
+	if strings.TrimSpace(c.Scope) == "" {
+		return DefaultScopes
+	}
+
+	return strings.Fields(c.Scope)
+}
+
+// HasScope reports whether the token grants scope. The admin scope grants every scope,
+// and an empty scope is always granted.
+func (c *Claims) HasScope(scope string) bool {
+	if scope == "" {
+		return true
+	}
+
+	for _, granted := range c.Scopes() {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerateTokenWithScopes(t *testing.T) {
+	token, err := GenerateToken([]byte("secret"), "dev-1", time.Hour, ScopeChat, ScopeHistoryRead)
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+
+	claims, err := ParseToken([]byte("secret"), token)
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+
+	if !claims.HasScope(ScopeChat) || !claims.HasScope(ScopeHistoryRead) {
+		t.Fatalf("expected chat and history:read scopes, got %q", claims.Scope)
+	}
+	if claims.HasScope(ScopePush) {
+		t.Fatalf("unexpected push scope in %q", claims.Scope)
+	}
+}
+
+func TestClaimsDefaultScopes(t *testing.T) {
+	claims := &Claims{Subject: "dev-1"}
+	if !claims.HasScope(ScopeChat) {
+		t.Fatal("expected legacy token to grant chat scope")
+	}
+	if claims.HasScope(ScopeAdmin) {
+		t.Fatal("expected legacy token to not grant admin scope")
+	}
+}
+
+func TestClaimsAdminGrantsAllScopes(t *testing.T) {
+	claims := &Claims{Subject: "ops", Scope: ScopeAdmin}
+	for _, scope := range []string{ScopeChat, ScopeHistoryRead, ScopePush} {
+		if !claims.HasScope(scope) {
+			t.Fatalf("expected admin to grant %q", scope)
+		}
+	}
+}
+
+func TestGenerateTokenUnknownScope(t *testing.T) {
+	if _, err := GenerateToken([]byte("secret"), "dev-1", 0, "root"); err == nil {
+		t.Fatal("expected unknown scope error")
+	}
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	KindCounter = "counter"
+	KindGauge   = "gauge"
+)
+
+type series struct {
+	value float64
+}
+
+type family struct {
+	help   string
+	kind   string
+	series map[string]*series
+}
+
+// Registry is a minimal in-process metrics store rendered in the Prometheus
+// text exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Describe registers help text and kind for a metric name. Metrics used
+// without being described are exported as untyped counters.
+func (r *Registry) Describe(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := r.family(name)
+	f.kind = kind
+	f.help = help
+}
+
+// Inc adds one to a counter. labels are key/value pairs.
+func (r *Registry) Inc(name string, labels ...string) {
+	r.Add(name, 1, labels...)
+}
+
+func (r *Registry) Add(name string, delta float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.series(name, labels).value += delta
+}
+
+func (r *Registry) Set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.series(name, labels).value = value
+}
+
+// Value returns the current value of a series, or zero when it does not exist.
+func (r *Registry) Value(name string, labels ...string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		return 0
+	}
+	s, ok := f.series[formatLabels(labels)]
+	if !ok {
+		return 0
+	}
+
+	return s.value
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, f.help)
+		}
+		kind := f.kind
+		if kind == "" {
+			kind = KindCounter
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", name, key, strconv.FormatFloat(f.series[key].value, 'g', -1, 64))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r *Registry) family(name string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{series: make(map[string]*series)}
+		r.families[name] = f
+	}
+
+	return f
+}
+
+func (r *Registry) series(name string, labels []string) *series {
+	f := r.family(name)
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Describe("requests_total", KindCounter, "Total requests.")
+	r.Inc("requests_total", "code", "ok")
+	r.Inc("requests_total", "code", "ok")
+	r.Inc("requests_total", "code", "error")
+	r.Set("circuit_open", 1)
+
+	buf := &bytes.Buffer{}
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"# HELP requests_total Total requests.\n",
+		"# TYPE requests_total counter\n",
+		`requests_total{code="ok"} 2` + "\n",
+		`requests_total{code="error"} 1` + "\n",
+		"circuit_open 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	if got := r.Value("requests_total", "code", "ok"); got != 2 {
+		t.Fatalf("expected value 2, got %v", got)
+	}
+}
@@ -0,0 +1,275 @@
+package pairing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const codeDigits = 8
+
+const (
+	StatusPending  = "pending"
+	StatusConsumed = "consumed"
+	StatusRevoked  = "revoked"
+	StatusExpired  = "expired"
+)
+
+var (
+	ErrNotFound    = errors.New("pairing not found")
+	ErrCodeInvalid = errors.New("pairing code is invalid, expired or already used")
+)
+
+// Pairing is a one-time code an admin hands to a device so it can fetch its own token.
+type Pairing struct {
+	ID             string     `json:"id"`
+	Code           string     `json:"code"`
+	DeviceID       string     `json:"deviceId"`
+	Scopes         []string   `json:"scopes,omitempty"`
+	TokenExpiresIn int64      `json:"tokenExpiresInSeconds,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	ConsumedAt     *time.Time `json:"consumedAt,omitempty"`
+	RevokedAt      *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (p *Pairing) Status(now time.Time) string {
+	switch {
+	case p.RevokedAt != nil:
+		return StatusRevoked
+	case p.ConsumedAt != nil:
+		return StatusConsumed
+	case !p.ExpiresAt.After(now):
+		return StatusExpired
+	default:
+		return StatusPending
+	}
+}
+
+type CreateRequest struct {
+	DeviceID       string
+	Scopes         []string
+	TTL            time.Duration
+	TokenExpiresIn time.Duration
+}
+
+// Store keeps pairings in memory and, when path is set, mirrors them to a JSON file
+// so codes and revocations survive restarts.
+type Store struct {
+	path string
+
+	mu       sync.Mutex
+	pairings map[string]*Pairing
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, pairings: make(map[string]*Pairing)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read pairing store: %w", err)
+	}
+
+	var pairings []*Pairing
+	if err := json.Unmarshal(data, &pairings); err != nil {
+		return nil, fmt.Errorf("unmarshal pairing store: %w", err)
+	}
+	for _, p := range pairings {
+		s.pairings[p.ID] = p
+	}
+
+	return s, nil
+}
+
+func (s *Store) Create(req CreateRequest) (*Pairing, error) {
+	if req.DeviceID == "" {
+		return nil, fmt.Errorf("deviceId is required")
+	}
+	if req.TTL <= 0 {
+		return nil, fmt.Errorf("ttl must be positive")
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, err := s.uniqueCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := &Pairing{
+		ID:             id,
+		Code:           code,
+		DeviceID:       req.DeviceID,
+		Scopes:         req.Scopes,
+		TokenExpiresIn: int64(req.TokenExpiresIn.Seconds()),
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(req.TTL),
+	}
+	s.pairings[id] = p
+	if err := s.saveLocked(); err != nil {
+		delete(s.pairings, id)
+		return nil, err
+	}
+
+	copied := *p
+	return &copied, nil
+}
+
+// Consume exchanges a pending code. Each code succeeds at most once.
+func (s *Store) Consume(code string) (*Pairing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, p := range s.pairings {
+		if p.Code != code || p.Status(now) != StatusPending {
+			continue
+		}
+
+		p.ConsumedAt = &now
+		if err := s.saveLocked(); err != nil {
+			p.ConsumedAt = nil
+			return nil, err
+		}
+
+		copied := *p
+		return &copied, nil
+	}
+
+	return nil, ErrCodeInvalid
+}
+
+func (s *Store) Revoke(id string) (*Pairing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pairings[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if p.RevokedAt == nil {
+		now := time.Now()
+		p.RevokedAt = &now
+		if err := s.saveLocked(); err != nil {
+			p.RevokedAt = nil
+			return nil, err
+		}
+	}
+
+	copied := *p
+	return &copied, nil
+}
+
+// IsRevoked reports whether a token issued for pairing id has been revoked.
+func (s *Store) IsRevoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pairings[id]
+	return ok && p.RevokedAt != nil
+}
+
+// List returns all pairings, newest first.
+func (s *Store) List() []Pairing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Pairing, 0, len(s.pairings))
+	for _, p := range s.pairings {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	return list
+}
+
+func (s *Store) uniqueCode() (string, error) {
+	now := time.Now()
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := randomCode()
+		if err != nil {
+			return "", err
+		}
+
+		inUse := false
+		for _, p := range s.pairings {
+			if p.Code == code && p.Status(now) == StatusPending {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return code, nil
+		}
+	}
+
+	return "", fmt.Errorf("generate unique pairing code: too many collisions")
+}
+
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	list := make([]*Pairing, 0, len(s.pairings))
+	for _, p := range s.pairings {
+		list = append(list, p)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal pairing store: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write pairing store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replace pairing store: %w", err)
+	}
+
+	return nil
+}
+
+func randomCode() (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < codeDigits; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", fmt.Errorf("generate pairing code: %w", err)
+	}
+
+	return fmt.Sprintf("%0*d", codeDigits, n), nil
+}
+
+func randomID() (string, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate pairing id: %w", err)
+	}
+
+	return hex.EncodeToString(raw), nil
+}
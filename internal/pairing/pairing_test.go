@@ -0,0 +1,81 @@
+package pairing
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreConsumeIsSingleUse(t *testing.T) {
+	s, err := NewStore("")
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	p, err := s.Create(CreateRequest{DeviceID: "dev-1", TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("create pairing: %v", err)
+	}
+	if len(p.Code) != codeDigits {
+		t.Fatalf("expected %d digit code, got %q", codeDigits, p.Code)
+	}
+
+	consumed, err := s.Consume(p.Code)
+	if err != nil {
+		t.Fatalf("consume pairing: %v", err)
+	}
+	if consumed.DeviceID != "dev-1" {
+		t.Fatalf("unexpected device id: %q", consumed.DeviceID)
+	}
+
+	if _, err := s.Consume(p.Code); !errors.Is(err, ErrCodeInvalid) {
+		t.Fatalf("expected ErrCodeInvalid on reuse, got %v", err)
+	}
+}
+
+func TestStoreExpiredCode(t *testing.T) {
+	s, _ := NewStore("")
+	p, err := s.Create(CreateRequest{DeviceID: "dev-1", TTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("create pairing: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := s.Consume(p.Code); !errors.Is(err, ErrCodeInvalid) {
+		t.Fatalf("expected ErrCodeInvalid for expired code, got %v", err)
+	}
+	if status := s.List()[0].Status(time.Now()); status != StatusExpired {
+		t.Fatalf("expected expired status, got %q", status)
+	}
+}
+
+func TestStoreRevokePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pairings.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	p, err := s.Create(CreateRequest{DeviceID: "dev-1", TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("create pairing: %v", err)
+	}
+	if _, err := s.Revoke(p.ID); err != nil {
+		t.Fatalf("revoke pairing: %v", err)
+	}
+	if _, err := s.Consume(p.Code); !errors.Is(err, ErrCodeInvalid) {
+		t.Fatalf("expected revoked code to be rejected, got %v", err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("reload store: %v", err)
+	}
+	if !reloaded.IsRevoked(p.ID) {
+		t.Fatal("expected revocation to survive reload")
+	}
+	if _, err := reloaded.Revoke("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Package proxyproto accepts connections prefixed with a HAProxy PROXY protocol
+// v1 or v2 header and reports the original client address as RemoteAddr.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const v1MaxLength = 107
+
+// Listener wraps accepted connections so the PROXY header is parsed on first
+// use, off the accept loop.
+type Listener struct {
+	net.Listener
+	// Trusted lists the peers that may send a header; empty trusts none.
+	// Connections from other peers are rejected.
+	Trusted []*net.IPNet
+	// HeaderTimeout bounds how long reading the header may take.
+	HeaderTimeout time.Duration
+}
+
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: ln, Trusted: trusted, HeaderTimeout: 5 * time.Second}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), trusted: l.Trusted, timeout: l.HeaderTimeout}, nil
+}
+
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted []*net.IPNet
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	if !c.peerTrusted() {
+		c.err = fmt.Errorf("proxy protocol header from untrusted peer %s", c.Conn.RemoteAddr())
+		_ = c.Conn.Close()
+		return
+	}
+
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	remote, err := ReadHeader(c.reader)
+	if err != nil {
+		c.err = err
+		_ = c.Conn.Close()
+		return
+	}
+	c.remote = remote
+}
+
+func (c *Conn) peerTrusted() bool {
+	tcpAddr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range c.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadHeader consumes a v1 or v2 header from r. It returns a nil address for
+// headers that carry no client address (v1 UNKNOWN, v2 LOCAL).
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(peek, v2Signature) {
+		return readV2(r)
+	}
+
+	peek, err = r.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy protocol header: %w", err)
+	}
+	if string(peek) == "PROXY " {
+		return readV1(r)
+	}
+
+	return nil, errors.New("missing proxy protocol header")
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read proxy protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1 header too long or unterminated")
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(line)))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header: %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source: %s:%s", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read proxy protocol v2 header: %w", err)
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", verCmd>>4)
+	}
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read proxy protocol v2 addresses: %w", err)
+	}
+
+	// LOCAL connections (health checks from the balancer itself) keep the peer address.
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if length < 12 {
+			return nil, errors.New("short proxy protocol v2 ipv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if length < 36 {
+			return nil, errors.New("short proxy protocol v2 ipv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if addr.String() != "203.0.113.7:51234" {
+		t.Fatalf("unexpected address: %s", addr)
+	}
+
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected remaining bytes: %q", rest)
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	buf.Write([]byte{0x21, 0x11})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(net.ParseIP("198.51.100.9").To4())
+	buf.Write(net.ParseIP("10.0.0.1").To4())
+	_ = binary.Write(&buf, binary.BigEndian, uint16(40000))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(443))
+	buf.WriteString("payload")
+
+	r := bufio.NewReader(&buf)
+	addr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if addr.String() != "198.51.100.9:40000" {
+		t.Fatalf("unexpected address: %s", addr)
+	}
+
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "payload" {
+		t.Fatalf("unexpected remaining bytes: %q", rest)
+	}
+}
+
+func TestReadHeaderMissing(t *testing.T) {
+	if _, err := ReadHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Fatal("expected error for connection without header")
+	}
+}
+
+func TestListenerRewritesRemoteAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pl := NewListener(ln, []*net.IPNet{loopback})
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP6 2001:db8::5 ::1 1000 443\r\nhello"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != "[2001:db8::5]:1000" {
+		t.Fatalf("unexpected remote addr: %s", got)
+	}
+	data, _ := io.ReadAll(conn)
+	if string(data) != "hello" {
+		t.Fatalf("unexpected payload: %q", data)
+	}
+}
+
+func TestListenerRejectsUntrustedPeer(t *testing.T) {
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	for name, trusted := range map[string][]*net.IPNet{"none": nil, "other": {other}} {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			pl := NewListener(ln, trusted)
+			defer pl.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 1000 443\r\nhello"))
+				_, _ = io.ReadAll(conn)
+			}()
+
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.RemoteAddr().String(); strings.HasPrefix(got, "203.0.113.7") {
+				t.Fatalf("forged address accepted: %s", got)
+			}
+			if _, err := conn.Read(make([]byte, 16)); err == nil {
+				t.Fatal("expected the untrusted connection to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ReasonRate  = "rate"
+	ReasonQuota = "quota"
+)
+
+// Limits for one key. Zero values mean unlimited.
+type Limits struct {
+	PerMinute  float64 `json:"perMinute,omitempty"`
+	Burst      int     `json:"burst,omitempty"`
+	DailyQuota int     `json:"dailyQuota,omitempty"`
+}
+
+// Override returns l with every non-zero field of o applied on top.
+func (l Limits) Override(o Limits) Limits {
+	if o.PerMinute > 0 {
+		l.PerMinute = o.PerMinute
+	}
+	if o.Burst > 0 {
+		l.Burst = o.Burst
+	}
+	if o.DailyQuota > 0 {
+		l.DailyQuota = o.DailyQuota
+	}
+
+	return l
+}
+
+func (l Limits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	if l.PerMinute >= 1 {
+		return l.PerMinute
+	}
+
+	return 1
+}
+
+type Decision struct {
+	Allowed bool
+	Reason  string
+	// ResetAt is when the request would next be allowed.
+	ResetAt time.Time
+}
+
+type Usage struct {
+	Key        string    `json:"key"`
+	Used       int       `json:"used"`
+	DailyQuota int       `json:"dailyQuota,omitempty"`
+	ResetAt    time.Time `json:"resetAt"`
+}
+
+type state struct {
+	tokens  float64
+	updated time.Time
+	day     time.Time
+	used    int
+	// quota is the daily quota applied by the most recent Allow.
+	quota int
+}
+
+// Limiter combines a token bucket and a daily quota per key. Days roll over at
+// midnight UTC.
+type Limiter struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*state
+}
+
+func New() *Limiter {
+	return &Limiter{now: time.Now, states: make(map[string]*state)}
+}
+
+// Allow consumes one request for key when both the bucket and the quota permit it.
+func (l *Limiter) Allow(key string, limits Limits) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	st := l.stateLocked(key, limits, now)
+	st.quota = limits.DailyQuota
+
+	if limits.DailyQuota > 0 && st.used >= limits.DailyQuota {
+		return Decision{Reason: ReasonQuota, ResetAt: st.day.AddDate(0, 0, 1)}
+	}
+
+	if limits.PerMinute > 0 {
+		st.tokens += now.Sub(st.updated).Minutes() * limits.PerMinute
+		if burst := limits.burst(); st.tokens > burst {
+			st.tokens = burst
+		}
+		st.updated = now
+
+		if st.tokens < 1 {
+			wait := time.Duration((1 - st.tokens) / limits.PerMinute * float64(time.Minute))
+			return Decision{Reason: ReasonRate, ResetAt: now.Add(wait)}
+		}
+		st.tokens--
+	}
+
+	st.used++
+	return Decision{Allowed: true}
+}
+
+// Usage reports the daily quota consumption of key. The quota is the one last
+// applied to key, or fallback's when key has not been seen yet. Looking a key
+// up does not start tracking it.
+func (l *Limiter) Usage(key string, fallback Limits) Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	today := startOfDay(l.now())
+	usage := Usage{Key: key, DailyQuota: fallback.DailyQuota, ResetAt: today.AddDate(0, 0, 1)}
+	if st, ok := l.states[key]; ok {
+		usage.DailyQuota = st.quota
+		if st.day.Equal(today) {
+			usage.Used = st.used
+		}
+	}
+
+	return usage
+}
+
+// List reports usage for every key seen today.
+func (l *Limiter) List() []Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	today := startOfDay(l.now())
+	list := make([]Usage, 0, len(l.states))
+	for key, st := range l.states {
+		if !st.day.Equal(today) {
+			continue
+		}
+		list = append(list, Usage{Key: key, Used: st.used, DailyQuota: st.quota, ResetAt: st.day.AddDate(0, 0, 1)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list
+}
+
+func (l *Limiter) stateLocked(key string, limits Limits, now time.Time) *state {
+	st, ok := l.states[key]
+	if !ok {
+		st = &state{tokens: limits.burst(), updated: now, day: startOfDay(now)}
+		l.states[key] = st
+	}
+	if day := startOfDay(now); !st.day.Equal(day) {
+		st.day = day
+		st.used = 0
+	}
+
+	return st
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
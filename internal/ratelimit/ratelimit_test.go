@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestLimiter(start time.Time) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: start}
+	l := New()
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l, clock := newTestLimiter(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	limits := Limits{PerMinute: 2, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow("dev-1", limits); !d.Allowed {
+			t.Fatalf("request %d: expected allowed", i)
+		}
+	}
+
+	d := l.Allow("dev-1", limits)
+	if d.Allowed || d.Reason != ReasonRate {
+		t.Fatalf("expected rate limited, got %+v", d)
+	}
+	if want := clock.t.Add(30 * time.Second); !d.ResetAt.Equal(want) {
+		t.Fatalf("expected reset at %s, got %s", want, d.ResetAt)
+	}
+
+	clock.t = clock.t.Add(30 * time.Second)
+	if d := l.Allow("dev-1", limits); !d.Allowed {
+		t.Fatalf("expected token refilled after 30s, got %+v", d)
+	}
+
+	if d := l.Allow("dev-2", limits); !d.Allowed {
+		t.Fatal("expected other key to have its own bucket")
+	}
+}
+
+func TestLimiterDailyQuota(t *testing.T) {
+	l, clock := newTestLimiter(time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC))
+	limits := Limits{DailyQuota: 2}
+
+	l.Allow("dev-1", limits)
+	l.Allow("dev-1", limits)
+	d := l.Allow("dev-1", limits)
+	if d.Allowed || d.Reason != ReasonQuota {
+		t.Fatalf("expected quota exceeded, got %+v", d)
+	}
+	if want := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC); !d.ResetAt.Equal(want) {
+		t.Fatalf("expected reset at %s, got %s", want, d.ResetAt)
+	}
+
+	if u := l.Usage("dev-1", limits); u.Used != 2 || u.DailyQuota != 2 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+
+	if u := l.Usage("dev-2", limits); u.Used != 0 || u.DailyQuota != 2 || len(l.List()) != 1 {
+		t.Fatalf("expected an unseen key to report the fallback without being tracked, got %+v %+v", u, l.List())
+	}
+
+	clock.t = clock.t.Add(2 * time.Hour)
+	if u := l.Usage("dev-1", limits); u.Used != 0 {
+		t.Fatalf("expected usage to reset on a new day, got %+v", u)
+	}
+	if d := l.Allow("dev-1", limits); !d.Allowed {
+		t.Fatalf("expected quota reset on new day, got %+v", d)
+	}
+}
+
+func TestLimitsOverride(t *testing.T) {
+	got := Limits{PerMinute: 10, Burst: 5, DailyQuota: 100}.Override(Limits{DailyQuota: 500})
+	if got.PerMinute != 10 || got.Burst != 5 || got.DailyQuota != 500 {
+		t.Fatalf("unexpected override result: %+v", got)
+	}
+}
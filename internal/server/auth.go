@@ -0,0 +1,242 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	claimsContextKey = "clawproxy.claims"
+
+	// wsProtocolName is echoed back when a browser authenticates through
+	// Sec-WebSocket-Protocol and also offers it.
+	wsProtocolName = "clawproxy.v1"
+	// wsBearerProtocolPrefix marks the subprotocol entry carrying the JWT.
+	wsBearerProtocolPrefix = "bearer."
+)
+
+func (s *Server) validateToken(tokenStr string) (*auth.Claims, error) {
+	claims, err := auth.ParseTokenWithKeys(tokenStr, s.tokenKeys)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID != "" && s.pairings.IsRevoked(claims.ID) {
+		return nil, errTokenRevoked
+	}
+	if err := auth.ValidateDeviceID(claims.Tenant, claims.Subject); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// requestToken extracts the JWT from the Authorization header, with or without
+// the Bearer prefix, falling back to the Sec-WebSocket-Protocol header.
+func requestToken(r *http.Request) string {
+	if header := strings.TrimSpace(r.Header.Get("Authorization")); header != "" {
+		if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+			return strings.TrimSpace(header[len("Bearer "):])
+		}
+		return header
+	}
+
+	for _, protocol := range wsSubprotocols(r) {
+		if strings.HasPrefix(protocol, wsBearerProtocolPrefix) {
+			return strings.TrimPrefix(protocol, wsBearerProtocolPrefix)
+		}
+	}
+
+	return ""
+}
+
+func wsSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+
+	return protocols
+}
+
+// wsSubprotocolHeader picks the subprotocol to echo in the upgrade response.
+// Browsers fail the handshake unless the server selects one of the offered protocols.
+func wsSubprotocolHeader(r *http.Request) http.Header {
+	var selected string
+	for _, protocol := range wsSubprotocols(r) {
+		if protocol == wsProtocolName {
+			selected = protocol
+			break
+		}
+		if selected == "" && strings.HasPrefix(protocol, wsBearerProtocolPrefix) {
+			selected = protocol
+		}
+	}
+	if selected == "" {
+		return nil
+	}
+
+	return http.Header{"Sec-Websocket-Protocol": []string{selected}}
+}
+
+// credentialFunc resolves claims from a bearer credential, writing the error
+// response itself on failure.
+type credentialFunc func(c *gin.Context, deviceID string) (*auth.Claims, bool)
+
+// authenticate validates the request credentials and checks that they grant scope for deviceID.
+// Callers may only act for the device in their subject unless they carry the admin scope.
+// On failure the error response has already been written.
+func (s *Server) authenticate(c *gin.Context, deviceID, scope string) (*auth.Claims, bool) {
+	claims, ok := s.identify(c, deviceID, s.tokenClaims)
+	if !ok || !s.authorize(c, claims, deviceID, scope) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// identify applies the auth mode of the listener the request arrived on.
+func (s *Server) identify(c *gin.Context, deviceID string, credential credentialFunc) (*auth.Claims, bool) {
+	l := requestListener(c.Request)
+	certClaims := certificateClaims(c.Request, l)
+
+	switch l.mode() {
+	case AuthModeMTLS:
+		if certClaims == nil {
+			log.Printf("[server] reject request: missing client certificate path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"code": "CERT_REQUIRED", "error": "verified client certificate is required"})
+			return nil, false
+		}
+		return certClaims, true
+	case AuthModeEither:
+		if certClaims != nil {
+			return certClaims, true
+		}
+		return credential(c, deviceID)
+	case AuthModeBoth:
+		if certClaims == nil {
+			log.Printf("[server] reject request: missing client certificate path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"code": "CERT_REQUIRED", "error": "verified client certificate is required"})
+			return nil, false
+		}
+		claims, ok := credential(c, deviceID)
+		if !ok {
+			return nil, false
+		}
+		if claims.Subject != certClaims.Subject {
+			log.Printf("[server] reject request: token and certificate identity mismatch path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, c.ClientIP())
+			c.JSON(http.StatusForbidden, gin.H{"code": "FORBIDDEN", "error": "token does not match client certificate"})
+			return nil, false
+		}
+		return claims, true
+	default:
+		return credential(c, deviceID)
+	}
+}
+
+func (s *Server) tokenClaims(c *gin.Context, deviceID string) (*auth.Claims, bool) {
+	clientIP := c.ClientIP()
+	token := requestToken(c.Request)
+	if token == "" {
+		log.Printf("[server] reject request: missing Authorization header path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, clientIP)
+		c.JSON(http.StatusUnauthorized, gin.H{"code": "TOKEN_REQUIRED", "error": "token is required"})
+		return nil, false
+	}
+
+	claims, err := s.validateToken(token)
+	if err != nil {
+		log.Printf("[server] reject request: invalid token path=%s session_id=%s client_ip=%s err=%v", c.FullPath(), deviceID, clientIP, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"code": "INVALID_TOKEN", "error": "token validation failed"})
+		return nil, false
+	}
+
+	return claims, true
+}
+
+func (s *Server) authorize(c *gin.Context, claims *auth.Claims, deviceID, scope string) bool {
+	// Certificate subjects skip validateToken, so check them here too.
+	for _, id := range []string{deviceID, claims.Subject} {
+		if err := auth.ValidateDeviceID(claims.Tenant, id); err != nil {
+			log.Printf("[server] reject request: invalid deviceId path=%s session_id=%s client_ip=%s", c.FullPath(), id, c.ClientIP())
+			c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_DEVICE_ID", "error": err.Error()})
+			return false
+		}
+	}
+	if !claims.HasScope(scope) {
+		log.Printf("[server] reject request: insufficient scope path=%s session_id=%s client_ip=%s required=%s", c.FullPath(), deviceID, c.ClientIP(), scope)
+		c.JSON(http.StatusForbidden, gin.H{"code": "FORBIDDEN", "error": "insufficient scope: " + scope + " required"})
+		return false
+	}
+	if deviceID != "" && claims.Subject != deviceID && !claims.HasScope(auth.ScopeAdmin) {
+		log.Printf("[server] reject request: token subject mismatch path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"code": "FORBIDDEN", "error": "token is not valid for this deviceId"})
+		return false
+	}
+
+	return true
+}
+
+// requireScope is middleware for routes that are not scoped to a single device.
+// Admin routes manage the whole proxy, so tenant admins are refused there.
+func (s *Server) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := s.authenticate(c, "", scope)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if scope == auth.ScopeAdmin && claims.Tenant != "" {
+			log.Printf("[server] reject request: tenant admin on proxy admin route path=%s tenant=%s", c.FullPath(), claims.Tenant)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": "FORBIDDEN", "error": "tenant tokens cannot use proxy admin routes"})
+			return
+		}
+
+		c.Set(claimsContextKey, claims)
+		c.Next()
+	}
+}
+
+func requestClaims(c *gin.Context) *auth.Claims {
+	claims, _ := c.MustGet(claimsContextKey).(*auth.Claims)
+	return claims
+}
+
+func (s *Server) handleWSTicket(c *gin.Context) {
+	claims := requestClaims(c)
+	ticket, expiresAt, err := s.tickets.issue(claims)
+	if err != nil {
+		log.Printf("[server] issue websocket ticket failed sub=%s err=%v", claims.Subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": "INTERNAL_ERROR", "error": "issue ticket failed"})
+		return
+	}
+
+	log.Printf("[server] websocket ticket issued sub=%s client_ip=%s", claims.Subject, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expiresAt": expiresAt.Unix()})
+}
+
+// ticketClaims returns a credentialFunc that redeems a one-time /ws ticket.
+func (s *Server) ticketClaims(ticket string) credentialFunc {
+	return func(c *gin.Context, deviceID string) (*auth.Claims, bool) {
+		claims, ok := s.tickets.redeem(ticket)
+		if !ok {
+			log.Printf("[server] reject websocket request: invalid ticket session_id=%s client_ip=%s", deviceID, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"code": "INVALID_TICKET", "error": "ticket is invalid or expired"})
+			return nil, false
+		}
+		if exp := claims.Expiry(); !exp.IsZero() && !exp.After(time.Now()) {
+			log.Printf("[server] reject websocket request: ticket token expired session_id=%s client_ip=%s", deviceID, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"code": "INVALID_TOKEN", "error": "token validation failed"})
+			return nil, false
+		}
+
+		return claims, true
+	}
+}
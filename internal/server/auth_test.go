@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleWS_BearerPrefix(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, "Bearer "+mustCreateToken(t))
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read websocket message: %v", err)
+	}
+}
+
+func TestHandleWS_SubprotocolToken(t *testing.T) {
+	exec := &fakeExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsProtocolName, wsBearerProtocolPrefix + mustCreateToken(t)}}
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != wsProtocolName {
+		t.Fatalf("expected subprotocol %q, got %q", wsProtocolName, conn.Subprotocol())
+	}
+}
+
+func issueTicket(t *testing.T, baseURL, token string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/ws-ticket", nil)
+	if err != nil {
+		t.Fatalf("build ticket request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request ticket: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode ticket response: %v", err)
+	}
+
+	return body.Ticket
+}
+
+func TestHandleWS_TicketIsSingleUse(t *testing.T) {
+	exec := &fakeExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	ticket := issueTicket(t, ts.URL, mustCreateToken(t))
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1&ticket=" + ticket
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial websocket with ticket: %v", err)
+	}
+	conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected reused ticket to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %+v", http.StatusUnauthorized, resp)
+	}
+}
+
+func TestWSTicket_RequiresToken(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	r := srv.Engine()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/ws-ticket", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
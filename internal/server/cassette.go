@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording is one executor run captured in a cassette, a JSON lines file
+// holding one recording per line.
+type Recording struct {
+	DeviceID string `json:"deviceId"`
+	Message  string `json:"message"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr,omitempty"`
+	// ExitCode is -1 when the command was killed by a signal.
+	ExitCode   int   `json:"exitCode"`
+	DurationMs int64 `json:"durationMs"`
+	// Error is set for failures other than a non-zero exit; Code and Status
+	// carry the proxy error, e.g. from the http executor.
+	Error      string    `json:"error,omitempty"`
+	Code       string    `json:"code,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+// LoadCassette reads every recording of a cassette file.
+func LoadCassette(file string) ([]Recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+	defer f.Close()
+
+	var recordings []Recording
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			return nil, fmt.Errorf("cassette %s line %d: empty line", file, line)
+		}
+		var rec Recording
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("cassette %s line %d: %w", file, line, err)
+		}
+		recordings = append(recordings, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read cassette %s: %w", file, err)
+	}
+
+	return recordings, nil
+}
+
+// RecordConfig captures every run of the executor to a cassette.
+type RecordConfig struct {
+	// Cassette is appended to, and created with mode 0600 when missing.
+	Cassette string `json:"cassette"`
+}
+
+func (c RecordConfig) Validate() error {
+	if c.Cassette == "" {
+		return errors.New("record: cassette is required")
+	}
+
+	return nil
+}
+
+// RecordingExecutor runs Next and appends each finished run to a cassette.
+// Runs cut short by the caller going away are not recorded; runs that hit
+// their deadline are, as TIMEOUT.
+type RecordingExecutor struct {
+	Next CommandExecutor
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewRecordingExecutor(next CommandExecutor, cfg RecordConfig) (*RecordingExecutor, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(cfg.Cassette, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+
+	return &RecordingExecutor{Next: next, file: f}, nil
+}
+
+func (e *RecordingExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e *RecordingExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	var stderr strings.Builder
+	var stderrMu sync.Mutex
+	ctx = withStderrSink(ctx, func(p []byte) {
+		stderrMu.Lock()
+		stderr.Write(p)
+		stderrMu.Unlock()
+	})
+
+	start := time.Now()
+	output, err := runExecutor(ctx, e.Next, deviceID, message, onOutput)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return output, err
+	}
+
+	stderrMu.Lock()
+	rec := Recording{
+		DeviceID:   deviceID,
+		Message:    message,
+		Stdout:     output,
+		Stderr:     stderr.String(),
+		DurationMs: time.Since(start).Milliseconds(),
+		RecordedAt: start.UTC(),
+	}
+	stderrMu.Unlock()
+	var exitErr interface{ ExitCode() int }
+	var msgErr *messageError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		timeout := contextError(ctx.Err())
+		rec.Error, rec.Code, rec.Status = timeout.Message, timeout.Code, timeout.Status
+	case errors.As(err, &exitErr):
+		rec.ExitCode = exitErr.ExitCode()
+	case errors.As(err, &msgErr):
+		rec.Error, rec.Code, rec.Status = msgErr.Message, msgErr.Code, msgErr.Status
+	default:
+		rec.Error = err.Error()
+	}
+	if recErr := e.append(rec); recErr != nil {
+		log.Printf("[executor] record run failed session_id=%s err=%v", deviceID, recErr)
+	}
+
+	return output, err
+}
+
+func (e *RecordingExecutor) append(rec Recording) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal recording: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the cassette.
+func (e *RecordingExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.file.Close()
+}
+
+func (e *RecordingExecutor) wrapped() []CommandExecutor {
+	return []CommandExecutor{e.Next}
+}
+
+// ReplayRule serves the recording on Line of the cassette to messages matching
+// Device, a path.Match glob on the session id, and Message, a regular
+// expression. Empty patterns match everything.
+type ReplayRule struct {
+	Device  string `json:"device,omitempty"`
+	Message string `json:"message,omitempty"`
+	Line    int    `json:"line"`
+}
+
+// ReplayConfig answers messages from a cassette instead of running openclaw.
+type ReplayConfig struct {
+	Cassette string `json:"cassette"`
+	// Rules are tried in order before looking up the recording with the same
+	// deviceId and message.
+	Rules []ReplayRule `json:"rules,omitempty"`
+	// IgnoreDevice looks recordings up by message alone.
+	IgnoreDevice bool `json:"ignoreDevice,omitempty"`
+	// Realtime waits the recorded duration before answering, so slow runs
+	// time out again under a shorter timeout. Recorded timeouts replay as
+	// TIMEOUT either way.
+	Realtime bool `json:"realtime,omitempty"`
+}
+
+func (c ReplayConfig) Validate() error {
+	if c.Cassette == "" {
+		return errors.New("replay: cassette is required")
+	}
+	for i, rule := range c.Rules {
+		if rule.Line < 1 {
+			return fmt.Errorf("replay: rule %d: line must be positive", i)
+		}
+		if _, err := path.Match(rule.Device, ""); err != nil {
+			return fmt.Errorf("replay: rule %d: device: %w", i, err)
+		}
+		if _, err := regexp.Compile(rule.Message); err != nil {
+			return fmt.Errorf("replay: rule %d: message: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+type replayRule struct {
+	device  string
+	message *regexp.Regexp
+	line    int
+}
+
+// ReplayExecutor serves recorded runs. A deviceId and message recorded several
+// times are answered in recorded order, repeating the last recording once
+// they run out.
+type ReplayExecutor struct {
+	cfg        ReplayConfig
+	recordings []Recording
+	rules      []replayRule
+
+	mu     sync.Mutex
+	served map[string]int
+}
+
+func NewReplayExecutor(cfg ReplayConfig) (*ReplayExecutor, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	recordings, err := LoadCassette(cfg.Cassette)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ReplayExecutor{cfg: cfg, recordings: recordings, served: make(map[string]int)}
+	for i, rule := range cfg.Rules {
+		if rule.Line > len(recordings) {
+			return nil, fmt.Errorf("replay: rule %d: cassette has %d recordings", i, len(recordings))
+		}
+		e.rules = append(e.rules, replayRule{device: rule.Device, message: regexp.MustCompile(rule.Message), line: rule.Line})
+	}
+
+	return e, nil
+}
+
+func (e *ReplayExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e *ReplayExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	rec, ok := e.lookup(deviceID, message)
+	if !ok {
+		log.Printf("[executor] no recording session_id=%s", deviceID)
+		return "", &messageError{Status: http.StatusNotFound, Code: "NO_RECORDING", Message: "no recording matches this message"}
+	}
+
+	if e.cfg.Realtime && rec.DurationMs > 0 {
+		timer := time.NewTimer(time.Duration(rec.DurationMs) * time.Millisecond)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+	}
+	if sink := stderrSinkFrom(ctx); sink != nil && rec.Stderr != "" {
+		sink([]byte(rec.Stderr))
+	}
+	if onOutput != nil && rec.Stdout != "" {
+		onOutput([]byte(rec.Stdout))
+	}
+
+	switch {
+	case rec.Code != "":
+		msgErr := &messageError{Status: rec.Status, Code: rec.Code, Message: rec.Error}
+		if rec.Code == "TIMEOUT" {
+			msgErr.Output = rec.Stdout
+		}
+		return rec.Stdout, msgErr
+	case rec.Error != "":
+		return rec.Stdout, errors.New(rec.Error)
+	case rec.ExitCode != 0:
+		return rec.Stdout, fmt.Errorf("run replay: %w", replayExitError(rec.ExitCode))
+	}
+
+	log.Printf("[executor] replayed recording session_id=%s output_bytes=%d", deviceID, len(rec.Stdout))
+	return rec.Stdout, nil
+}
+
+func (e *ReplayExecutor) lookup(deviceID, message string) (Recording, bool) {
+	for _, rule := range e.rules {
+		if matched, _ := path.Match(rule.device, deviceID); (rule.device == "" || matched) && rule.message.MatchString(message) {
+			return e.recordings[rule.line-1], true
+		}
+	}
+
+	var matches []int
+	for i, rec := range e.recordings {
+		if rec.Message == message && (e.cfg.IgnoreDevice || rec.DeviceID == deviceID) {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return Recording{}, false
+	}
+
+	key := message
+	if !e.cfg.IgnoreDevice {
+		key = deviceID + "\x00" + message
+	}
+	e.mu.Lock()
+	n := e.served[key]
+	e.served[key] = n + 1
+	e.mu.Unlock()
+
+	return e.recordings[matches[min(n, len(matches)-1)]], true
+}
+
+// replayExitError is a recorded non-zero exit; like *exec.ExitError it
+// reports the code to retry rules.
+type replayExitError int
+
+func (e replayExitError) Error() string {
+	if e < 0 {
+		return "signal: killed"
+	}
+
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e replayExitError) ExitCode() int {
+	return int(e)
+}
+
+type stderrSinkKey struct{}
+
+// withStderrSink lets a recorder see the stderr of commands run under ctx.
+func withStderrSink(ctx context.Context, sink func([]byte)) context.Context {
+	return context.WithValue(ctx, stderrSinkKey{}, sink)
+}
+
+func stderrSinkFrom(ctx context.Context) func([]byte) {
+	sink, _ := ctx.Value(stderrSinkKey{}).(func([]byte))
+	return sink
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func writeCassette(t *testing.T, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("write cassette: %v", err)
+	}
+
+	return file
+}
+
+func TestRecordingExecutor_CapturesCommandRuns(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := NewRecordingExecutor(TemplateExecutor{
+		Binary: "sh",
+		Args:   []string{"-c", `echo "{\"reply\":\"$1\"}"; echo warn >&2; [ "$1" = ok ] || exit 3`, "sh", "{{.Message}}"},
+	}, RecordConfig{Cassette: file})
+	if err != nil {
+		t.Fatalf("new recorder: %v", err)
+	}
+
+	if _, err := recorder.Run(context.Background(), "device-1", "ok"); err != nil {
+		t.Fatalf("run ok: %v", err)
+	}
+	if _, err := recorder.Run(context.Background(), "device-1", "bad"); err == nil {
+		t.Fatal("expected the failing run to fail")
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder.Run(canceled, "device-1", "ok")
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("close recorder: %v", err)
+	}
+
+	recordings, err := LoadCassette(file)
+	if err != nil {
+		t.Fatalf("load cassette: %v", err)
+	}
+	if len(recordings) != 2 {
+		t.Fatalf("expected 2 recordings, got %#v", recordings)
+	}
+	ok, bad := recordings[0], recordings[1]
+	if ok.DeviceID != "device-1" || ok.Message != "ok" || ok.Stdout != "{\"reply\":\"ok\"}\n" || ok.Stderr != "warn\n" || ok.ExitCode != 0 {
+		t.Fatalf("unexpected recording %#v", ok)
+	}
+	if bad.ExitCode != 3 || bad.Stdout != "{\"reply\":\"bad\"}\n" {
+		t.Fatalf("unexpected failed recording %#v", bad)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a 0600 cassette, got %v %v", info.Mode(), err)
+	}
+}
+
+func TestRecordingExecutor_ReplaysTimeouts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := NewRecordingExecutor(TemplateExecutor{Binary: "sh", Args: []string{"-c", "printf partial; sleep 30"}}, RecordConfig{Cassette: file})
+	if err != nil {
+		t.Fatalf("new recorder: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(withKillGrace(context.Background(), 100*time.Millisecond), 200*time.Millisecond)
+	defer cancel()
+	recorder.Run(ctx, "device-1", "slow")
+	recorder.Close()
+
+	replay, err := NewReplayExecutor(ReplayConfig{Cassette: file})
+	if err != nil {
+		t.Fatalf("new replay: %v", err)
+	}
+	if rec := replay.recordings[0]; rec.Code != "TIMEOUT" || rec.Stdout != "partial" {
+		t.Fatalf("expected a recorded TIMEOUT with partial output, got %#v", rec)
+	}
+
+	srv := NewWithExecutor(":0", testJWTSecret, replay)
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "slow"})
+	if w.Code != http.StatusGatewayTimeout || decodeErrorCode(t, w.Body.Bytes()) != "TIMEOUT" || !strings.Contains(w.Body.String(), "partial") {
+		t.Fatalf("expected the timeout to replay, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReplayExecutor_ServesRecordingsInOrder(t *testing.T) {
+	replay, err := NewReplayExecutor(ReplayConfig{Cassette: writeCassette(t,
+		`{"deviceId":"device-1","message":"hi","stdout":"first"}`,
+		`{"deviceId":"device-1","message":"hi","stdout":"second"}`,
+		`{"deviceId":"device-2","message":"hi","stdout":"other"}`,
+	)})
+	if err != nil {
+		t.Fatalf("new replay: %v", err)
+	}
+
+	for _, want := range []string{"first", "second", "second"} {
+		if output, err := replay.Run(context.Background(), "device-1", "hi"); err != nil || output != want {
+			t.Fatalf("expected %q, got %q %v", want, output, err)
+		}
+	}
+	if output, _ := replay.Run(context.Background(), "device-2", "hi"); output != "other" {
+		t.Fatalf("expected device-2's recording, got %q", output)
+	}
+
+	_, err = replay.Run(context.Background(), "device-3", "hi")
+	var msgErr *messageError
+	if !errors.As(err, &msgErr) || msgErr.Code != "NO_RECORDING" {
+		t.Fatalf("expected NO_RECORDING, got %v", err)
+	}
+}
+
+func TestReplayExecutor_RulesAndIgnoreDevice(t *testing.T) {
+	cassette := writeCassette(t,
+		`{"deviceId":"device-1","message":"weather today?","stdout":"sunny"}`,
+		`{"deviceId":"device-1","message":"hi","stdout":"hello"}`,
+	)
+	replay, err := NewReplayExecutor(ReplayConfig{
+		Cassette:     cassette,
+		IgnoreDevice: true,
+		Rules:        []ReplayRule{{Device: "team:*", Message: `(?i)weather`, Line: 1}},
+	})
+	if err != nil {
+		t.Fatalf("new replay: %v", err)
+	}
+
+	if output, _ := replay.Run(context.Background(), "team:phone", "Weather tomorrow?"); output != "sunny" {
+		t.Fatalf("expected the rule's recording, got %q", output)
+	}
+	if _, err := replay.Run(context.Background(), "phone", "Weather tomorrow?"); err == nil {
+		t.Fatal("expected no match outside the rule's devices")
+	}
+	if output, _ := replay.Run(context.Background(), "phone", "hi"); output != "hello" {
+		t.Fatalf("expected the message match on any device, got %q", output)
+	}
+
+	if _, err := NewReplayExecutor(ReplayConfig{Cassette: cassette, Rules: []ReplayRule{{Line: 3}}}); err == nil {
+		t.Fatal("expected a rule past the cassette's end to be rejected")
+	}
+}
+
+func TestReplayExecutor_ReplaysFailures(t *testing.T) {
+	replay, err := NewReplayExecutor(ReplayConfig{Cassette: writeCassette(t,
+		`{"deviceId":"d","message":"crash","stdout":"partial","exitCode":3}`,
+		`{"deviceId":"d","message":"down","error":"upstream unavailable","code":"UPSTREAM_UNAVAILABLE","status":503}`,
+	)})
+	if err != nil {
+		t.Fatalf("new replay: %v", err)
+	}
+
+	output, err := replay.Run(context.Background(), "d", "crash")
+	if output != "partial" || !(RetryConfig{ExitCodes: []int{3}}).retryable(err) {
+		t.Fatalf("expected a retryable exit 3 with partial output, got %q %v", output, err)
+	}
+	_, err = replay.Run(context.Background(), "d", "down")
+	var msgErr *messageError
+	if !errors.As(err, &msgErr) || msgErr.Code != "UPSTREAM_UNAVAILABLE" || msgErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected the recorded proxy error, got %v", err)
+	}
+}
+
+func TestReplayExecutor_DrivesWebSocketPipeline(t *testing.T) {
+	replay, err := NewReplayExecutor(ReplayConfig{Cassette: writeCassette(t,
+		`{"deviceId":"device-1","message":"hello","stdout":"log line\n{\"result\":\"recorded\"}\n","stderr":"warn\n"}`,
+	)})
+	if err != nil {
+		t.Fatalf("new replay: %v", err)
+	}
+	srv := NewWithExecutor(":0", testJWTSecret, replay)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateToken(t))
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read websocket message: %v", err)
+	}
+	if string(message) != `{"result":"recorded"}` {
+		t.Fatalf("expected the recorded reply, got %q", message)
+	}
+}
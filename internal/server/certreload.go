@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var certWatchInterval = 30 * time.Second
+
+// certReloader serves a TLS key pair through tls.Config.GetCertificate and swaps
+// it when the files change, so renewals never drop open connections.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	loadedAt time.Time
+	lastErr  error
+	// seenModTime is the newest file modification time a reload was attempted for.
+	seenModTime time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// reload loads the key pair from disk. On failure the previous certificate keeps
+// being served and the error is kept for readiness reporting.
+func (r *certReloader) reload() error {
+	modTime := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seenModTime = modTime
+	if err != nil {
+		r.lastErr = fmt.Errorf("load tls key pair %s: %w", r.certPath, err)
+		return r.lastErr
+	}
+
+	r.cert = &cert
+	r.loadedAt = time.Now()
+	r.lastErr = nil
+	return nil
+}
+
+// reloadIfChanged reloads when either file changed since the last attempt.
+func (r *certReloader) reloadIfChanged() {
+	r.mu.RLock()
+	seen := r.seenModTime
+	r.mu.RUnlock()
+
+	if !r.filesModTime().After(seen) {
+		return
+	}
+
+	r.logReload("file change")
+}
+
+func (r *certReloader) logReload(trigger string) {
+	if err := r.reload(); err != nil {
+		log.Printf("[server] tls certificate reload failed cert=%s trigger=%s err=%v", r.certPath, trigger, err)
+		return
+	}
+
+	log.Printf("[server] tls certificate reloaded cert=%s trigger=%s", r.certPath, trigger)
+}
+
+func (r *certReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+// check is the readiness check for this certificate.
+func (r *certReloader) check() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.lastErr != nil {
+		return fmt.Errorf("%w (serving certificate loaded at %s)", r.lastErr, r.loadedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// watch polls the files until done is closed.
+func (r *certReloader) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reloadIfChanged()
+		case <-done:
+			return
+		}
+	}
+}
+
+// watchCertificates reloads every certificate on SIGHUP and polls the files for
+// changes until done is closed.
+func watchCertificates(reloaders []*certReloader, done <-chan struct{}) {
+	for _, r := range reloaders {
+		go r.watch(done)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			for _, r := range reloaders {
+				r.logReload("SIGHUP")
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func servedSerial(t *testing.T, r *certReloader) int64 {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("get certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse served certificate: %v", err)
+	}
+
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader_ReloadsChangedFiles(t *testing.T) {
+	p := newTestPKI(t)
+	certPEM, keyPEM := p.issue(t, "clawproxy", 10, true)
+	certPath := p.write(t, "server.pem", certPEM)
+	keyPath := p.write(t, "server-key.pem", keyPEM)
+
+	r, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load certificate: %v", err)
+	}
+	if got := servedSerial(t, r); got != 10 {
+		t.Fatalf("expected serial 10, got %d", got)
+	}
+
+	certPEM, keyPEM = p.issue(t, "clawproxy", 11, true)
+	p.write(t, "server.pem", certPEM)
+	p.write(t, "server-key.pem", keyPEM)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certPath, future, future)
+
+	r.reloadIfChanged()
+	if got := servedSerial(t, r); got != 11 {
+		t.Fatalf("expected reloaded serial 11, got %d", got)
+	}
+}
+
+func TestCertReloader_FailureKeepsCertificateAndFailsReadiness(t *testing.T) {
+	p := newTestPKI(t)
+	certPEM, keyPEM := p.issue(t, "clawproxy", 20, true)
+	certPath := p.write(t, "server.pem", certPEM)
+	keyPath := p.write(t, "server-key.pem", keyPEM)
+
+	r, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load certificate: %v", err)
+	}
+
+	p.write(t, "server.pem", []byte("not a certificate"))
+	if err := r.reload(); err == nil {
+		t.Fatal("expected reload error for corrupt certificate")
+	}
+	if got := servedSerial(t, r); got != 20 {
+		t.Fatalf("expected previous serial 20 to keep serving, got %d", got)
+	}
+
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	srv.readiness.add("tls :8443", r.check)
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	w := httptest.NewRecorder()
+	srv.Engine().ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "load tls key pair") {
+		t.Fatalf("unexpected readyz body: %s", w.Body.String())
+	}
+
+	p.write(t, "server.pem", certPEM)
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload restored certificate: %v", err)
+	}
+	w = httptest.NewRecorder()
+	srv.Engine().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d after recovery, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"clawproxy/internal/auth"
+)
+
+// DefaultCommandArgs is the built-in openclaw invocation.
+var DefaultCommandArgs = []string{"agent", "--session-id", "{{.DeviceID}}", "--message", "{{.Message}}", "--json"}
+
+// How the message reaches the command. Argv exposes it to ps and is bounded by
+// ARG_MAX; stdin and file keep it out of the argument list.
+const (
+	MessageModeArgv  = "argv"
+	MessageModeStdin = "stdin"
+	// MessageModeFile writes the message to a private temp file, removed after
+	// the run, whose path templates get as {{.MessageFile}}.
+	MessageModeFile = "file"
+)
+
+// messageSentinel stands in for the message while validating templates.
+const messageSentinel = "\x00clawproxy-message\x00"
+
+// CommandData is what argument templates can reference.
+type CommandData struct {
+	// DeviceID is the session id, prefixed with the tenant for tenant tokens.
+	DeviceID string
+	// Message is empty unless the message mode is argv.
+	Message string
+	// MessageFile is the message's temp file path in file mode.
+	MessageFile string
+	Tenant      string
+	// Subject is the sub claim of the caller's token.
+	Subject string
+}
+
+// TemplateExecutor runs a command whose arguments are text/template strings
+// rendered per message, e.g. to call a wrapper script or pass extra flags.
+type TemplateExecutor struct {
+	Binary string `json:"binary"`
+	// Args holds one template per argument; a rendered argument is passed as is,
+	// even when empty.
+	Args    []string `json:"args"`
+	Env     []string `json:"env,omitempty"`
+	WorkDir string   `json:"workDir,omitempty"`
+	// MessageMode is argv (default), stdin or file.
+	MessageMode string  `json:"messageMode,omitempty"`
+	Sandbox     Sandbox `json:"sandbox,omitempty"`
+}
+
+// Validate checks that the binary is set and every argument template renders.
+func (e TemplateExecutor) Validate() error {
+	if e.Binary == "" {
+		return errors.New("command: binary is required")
+	}
+	for _, kv := range e.Env {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("command: env entry %q must be KEY=VALUE", kv)
+		}
+	}
+	usesMessage, err := e.renders(CommandData{Message: messageSentinel})
+	if err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+	usesFile, err := e.renders(CommandData{MessageFile: messageSentinel})
+	if err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+	switch e.MessageMode {
+	case "", MessageModeArgv:
+	case MessageModeStdin:
+		if usesMessage {
+			return errors.New("command: args must not use {{.Message}} when messageMode is stdin")
+		}
+	case MessageModeFile:
+		if usesMessage || !usesFile {
+			return errors.New("command: args must use {{.MessageFile}} and not {{.Message}} when messageMode is file")
+		}
+	default:
+		return fmt.Errorf("command: unknown messageMode %q, expected argv, stdin or file", e.MessageMode)
+	}
+	if err := e.Sandbox.validate(); err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+
+	return nil
+}
+
+// renders reports whether the sentinel placed in data shows up in the args.
+func (e TemplateExecutor) renders(data CommandData) (bool, error) {
+	args, err := e.render(data)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, messageSentinel) }), nil
+}
+
+func (e TemplateExecutor) render(data CommandData) ([]string, error) {
+	args := make([]string, 0, len(e.Args))
+	for i, raw := range e.Args {
+		tmpl, err := template.New(strconv.Itoa(i)).Option("missingkey=error").Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse arg %d %q: %w", i, raw, err)
+		}
+		var arg strings.Builder
+		if err := tmpl.Execute(&arg, data); err != nil {
+			return nil, fmt.Errorf("render arg %d %q: %w", i, raw, err)
+		}
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// command builds the command for data; call release once it has finished.
+func (e TemplateExecutor) command(ctx context.Context, data CommandData) (cmd *exec.Cmd, release func(), err error) {
+	args, err := e.render(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args = append(args, optionArgsFrom(ctx)...)
+	cmd = exec.CommandContext(ctx, e.Binary, args...)
+	cmd.Env = e.Sandbox.environ(e.Env)
+	cmd.Dir = e.WorkDir
+	if release, err = e.Sandbox.prepare(cmd, data.DeviceID, killGraceFrom(ctx)); err != nil {
+		return nil, nil, err
+	}
+	return cmd, release, nil
+}
+
+func (e TemplateExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e TemplateExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	name := filepath.Base(e.Binary)
+	log.Printf("[executor] start %s command session_id=%s", name, deviceID)
+	data := CommandData{DeviceID: deviceID, Message: message}
+	if claims := callerClaims(ctx); claims != nil {
+		data.Tenant = claims.Tenant
+		data.Subject = claims.Subject
+	}
+	if e.MessageMode == MessageModeStdin || e.MessageMode == MessageModeFile {
+		data.Message = ""
+	}
+	if e.MessageMode == MessageModeFile {
+		path, err := writeMessageFile(message)
+		if err != nil {
+			log.Printf("[executor] write message file failed session_id=%s err=%v", deviceID, err)
+			return "", err
+		}
+		defer func() {
+			if err := os.Remove(path); err != nil {
+				log.Printf("[executor] remove message file failed session_id=%s err=%v", deviceID, err)
+			}
+		}()
+		if err := e.Sandbox.chown(path); err != nil {
+			log.Printf("[executor] chown message file failed session_id=%s err=%v", deviceID, err)
+			return "", err
+		}
+		data.MessageFile = path
+	}
+	cmd, release, err := e.command(ctx, data)
+	if err != nil {
+		log.Printf("[executor] build %s command failed session_id=%s err=%v", name, deviceID, err)
+		return "", fmt.Errorf("build %s command: %w", name, err)
+	}
+	defer release()
+	if e.MessageMode == MessageModeStdin {
+		cmd.Stdin = strings.NewReader(message)
+	}
+
+	var stdoutBuffer bytes.Buffer
+	var stderrBuffer bytes.Buffer
+	cmd.Stdout = &stdoutBuffer
+	if onOutput != nil {
+		cmd.Stdout = io.MultiWriter(&stdoutBuffer, outputFunc(onOutput))
+	}
+	cmd.Stderr = &stderrBuffer
+	if sink := stderrSinkFrom(ctx); sink != nil {
+		cmd.Stderr = io.MultiWriter(&stderrBuffer, outputFunc(sink))
+	}
+
+	err = cmd.Run()
+	stdout := stdoutBuffer.String()
+	stderr := stderrBuffer.String()
+
+	if stderr != "" {
+		log.Printf("[executor] %s command warning/error output session_id=%s stderr=%q", name, deviceID, stderr)
+	}
+
+	if err != nil {
+		log.Printf("[executor] %s command failed session_id=%s err=%v", name, deviceID, err)
+		return stdout, fmt.Errorf("run %s command: %w", name, err)
+	}
+
+	log.Printf("[executor] %s command finished session_id=%s output_bytes=%d", name, deviceID, len(stdout))
+	return stdout, nil
+}
+
+// writeMessageFile stores message in a new 0600 temp file and returns its path.
+func writeMessageFile(message string) (string, error) {
+	f, err := os.CreateTemp("", "clawproxy-message-*")
+	if err != nil {
+		return "", fmt.Errorf("create message file: %w", err)
+	}
+	if _, err := f.WriteString(message); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("write message file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("close message file: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// outputFunc adapts a chunk callback to io.Writer.
+type outputFunc func([]byte)
+
+func (f outputFunc) Write(p []byte) (int, error) {
+	f(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// literalArg quotes s as a template that renders to exactly s.
+func literalArg(s string) string {
+	return "{{" + strconv.Quote(s) + "}}"
+}
+
+type callerClaimsKey struct{}
+
+// withCallerClaims lets executors see who sent the message they are running.
+func withCallerClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, callerClaimsKey{}, claims)
+}
+
+func callerClaims(ctx context.Context) *auth.Claims {
+	claims, _ := ctx.Value(callerClaimsKey{}).(*auth.Claims)
+	return claims
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -35,3 +37,116 @@ func TestExtractJSONObject(t *testing.T) {
 		t.Fatalf("unexpected json part: %s", jsonPart)
 	}
 }
+
+func TestTemplateExecutorCommand(t *testing.T) {
+	e := TemplateExecutor{
+		Binary:  "/opt/bin/claw-wrapper",
+		Args:    []string{"--tenant={{.Tenant}}", "run", "{{.DeviceID}}", "{{.Message}}", ""},
+		Env:     []string{"CLAW_PROFILE=fast"},
+		WorkDir: "/srv/claw",
+	}
+	cmd, _, err := e.command(context.Background(), CommandData{DeviceID: "team-a:dev-1", Message: "hi {{there}}", Tenant: "team-a"})
+	if err != nil {
+		t.Fatalf("build command: %v", err)
+	}
+
+	expectedArgs := []string{"/opt/bin/claw-wrapper", "--tenant=team-a", "run", "team-a:dev-1", "hi {{there}}", ""}
+	if strings.Join(cmd.Args, "\x00") != strings.Join(expectedArgs, "\x00") {
+		t.Fatalf("expected args %#v, got %#v", expectedArgs, cmd.Args)
+	}
+	if cmd.Dir != "/srv/claw" || cmd.Env[len(cmd.Env)-1] != "CLAW_PROFILE=fast" {
+		t.Fatalf("unexpected dir %q or env tail %q", cmd.Dir, cmd.Env[len(cmd.Env)-1])
+	}
+}
+
+func TestOpenClawExecutorTemplate_Agent(t *testing.T) {
+	cmd, _, err := OpenClawExecutor{Binary: "/usr/local/bin/openclaw", Agent: `support "{{x}}"`}.Template().command(context.Background(), CommandData{DeviceID: "dev-1", Message: "hello"})
+	if err != nil {
+		t.Fatalf("build command: %v", err)
+	}
+
+	expectedArgs := []string{"/usr/local/bin/openclaw", "agent", "--agent", `support "{{x}}"`, "--session-id", "dev-1", "--message", "hello", "--json"}
+	if strings.Join(cmd.Args, "\x00") != strings.Join(expectedArgs, "\x00") {
+		t.Fatalf("expected args %#v, got %#v", expectedArgs, cmd.Args)
+	}
+}
+
+func TestTemplateExecutorValidate(t *testing.T) {
+	if err := (TemplateExecutor{Binary: "openclaw", Args: DefaultCommandArgs}).Validate(); err != nil {
+		t.Fatalf("expected default args to validate: %v", err)
+	}
+	for _, e := range []TemplateExecutor{
+		{Args: DefaultCommandArgs},
+		{Binary: "openclaw", Args: []string{"{{.Unknown}}"}},
+		{Binary: "openclaw", Args: []string{"{{.Message"}},
+		{Binary: "openclaw", Env: []string{"NOVALUE"}},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", e)
+		}
+	}
+}
+
+func TestTemplateExecutorRun(t *testing.T) {
+	e := TemplateExecutor{Binary: "sh", Args: []string{"-c", `printf '{"echo":"%s"}' "$1"`, "sh", "{{.Message}}"}}
+	out, err := e.Run(context.Background(), "dev-1", "hello")
+	if err != nil {
+		t.Fatalf("run template executor: %v", err)
+	}
+	if out != `{"echo":"hello"}` {
+		t.Fatalf("unexpected output: %s", out)
+	}
+}
+
+func TestTemplateExecutorRun_LargeMessage(t *testing.T) {
+	message := strings.Repeat("0123456789abcdef", 4<<16)
+	tests := map[string]TemplateExecutor{
+		MessageModeStdin: {Binary: "cat", MessageMode: MessageModeStdin},
+		MessageModeFile:  {Binary: "cat", Args: []string{"{{.MessageFile}}"}, MessageMode: MessageModeFile},
+	}
+	for mode, e := range tests {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+
+		out, err := e.Run(context.Background(), "dev-1", message)
+		if err != nil {
+			t.Fatalf("%s: run: %v", mode, err)
+		}
+		if out != message {
+			t.Fatalf("%s: message did not round-trip: got %d bytes, want %d", mode, len(out), len(message))
+		}
+		if left, _ := os.ReadDir(tmp); len(left) != 0 {
+			t.Fatalf("%s: expected temp files to be removed, found %d", mode, len(left))
+		}
+	}
+}
+
+func TestWriteMessageFile_Private(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	path, err := writeMessageFile("secret prompt")
+	if err != nil {
+		t.Fatalf("write message file: %v", err)
+	}
+	defer os.Remove(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat message file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("expected mode 0600, got %o", perm)
+	}
+}
+
+func TestTemplateExecutorValidate_MessageMode(t *testing.T) {
+	for _, e := range []TemplateExecutor{
+		{Binary: "openclaw", Args: DefaultCommandArgs, MessageMode: MessageModeStdin},
+		{Binary: "openclaw", Args: []string{"--message", "{{.Message}}"}, MessageMode: MessageModeFile},
+		{Binary: "openclaw", Args: []string{"agent"}, MessageMode: MessageModeFile},
+		{Binary: "openclaw", MessageMode: "pipe"},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", e)
+		}
+	}
+}
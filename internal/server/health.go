@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type readiness struct {
+	mu     sync.Mutex
+	checks []readinessCheck
+}
+
+func (r *readiness) add(name string, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, readinessCheck{name: name, check: check})
+}
+
+// run returns the result of every check keyed by name and whether all passed.
+func (r *readiness) run() (map[string]string, bool) {
+	r.mu.Lock()
+	checks := append([]readinessCheck(nil), r.checks...)
+	r.mu.Unlock()
+
+	results := make(map[string]string, len(checks))
+	ready := true
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			results[c.name] = err.Error()
+			ready = false
+			continue
+		}
+		results[c.name] = "ok"
+	}
+
+	return results, ready
+}
+
+func (s *Server) handleReadyz(c *gin.Context) {
+	results, ready := s.readiness.run()
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": results})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": results})
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+const (
+	defaultIdempotencyTTL = 10 * time.Minute
+	maxIdempotencyKeyLen  = 255
+)
+
+// Outcomes of idempotencyStore.begin.
+const (
+	idempotencyNew      = "new"
+	idempotencyCached   = "cached"
+	idempotencyAttached = "attached"
+)
+
+// idempotentRun is one run shared by every request with the same key. done is
+// closed once result and err are set.
+type idempotentRun struct {
+	digest  [sha256.Size]byte
+	done    chan struct{}
+	result  string
+	err     error
+	expires time.Time
+
+	// mu guards the progress so far, replayed to requests that attach late,
+	// and the requests watching it.
+	mu       sync.Mutex
+	status   string
+	output   []byte
+	watchers []*runWatcher
+}
+
+// runWatcher hands a run's progress and output to one request in order, from
+// its own goroutine, so a slow client cannot hold up the run or the other
+// requests attached to it.
+type runWatcher struct {
+	progress func(status string)
+	output   func([]byte)
+
+	mu      sync.Mutex
+	pending []func()
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func (w *runWatcher) send(event func()) {
+	w.mu.Lock()
+	if !w.closed {
+		w.pending = append(w.pending, event)
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *runWatcher) deliver() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		events, closed := w.pending, w.closed
+		w.pending = nil
+		w.mu.Unlock()
+
+		for _, event := range events {
+			event()
+		}
+		if closed {
+			return
+		}
+		<-w.wake
+	}
+}
+
+// close stops the watcher once what it was sent has been delivered, or at
+// once when drain is false, and waits for it.
+func (w *runWatcher) close(drain bool) {
+	w.mu.Lock()
+	w.closed = true
+	if !drain {
+		w.pending = nil
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	<-w.done
+}
+
+// watch forwards the run's progress and output to opts' callbacks, starting
+// with what happened before, until stop is called. stop delivers what is
+// still queued first when drain is set.
+func (run *idempotentRun) watch(opts runOptions) (stop func(drain bool)) {
+	if opts.progress == nil && opts.output == nil {
+		return func(bool) {}
+	}
+	w := &runWatcher{progress: opts.progress, output: opts.output, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go w.deliver()
+
+	run.mu.Lock()
+	if status := run.status; status != "" {
+		w.sendProgress(status)
+	}
+	if len(run.output) > 0 {
+		w.sendOutput(append([]byte(nil), run.output...))
+	}
+	run.watchers = append(run.watchers, w)
+	run.mu.Unlock()
+
+	return func(drain bool) {
+		run.mu.Lock()
+		run.watchers = slices.DeleteFunc(run.watchers, func(other *runWatcher) bool { return other == w })
+		run.mu.Unlock()
+		w.close(drain)
+	}
+}
+
+func (w *runWatcher) sendProgress(status string) {
+	if w.progress != nil {
+		w.send(func() { w.progress(status) })
+	}
+}
+
+func (w *runWatcher) sendOutput(p []byte) {
+	if w.output != nil {
+		w.send(func() { w.output(p) })
+	}
+}
+
+func (run *idempotentRun) progress(status string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.status = status
+	for _, w := range run.watchers {
+		w.sendProgress(status)
+	}
+}
+
+func (run *idempotentRun) chunk(p []byte) {
+	// Watchers get the chunk later, so it must not share the executor's buffer.
+	p = append([]byte(nil), p...)
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.output = append(run.output, p...)
+	for _, w := range run.watchers {
+		w.sendOutput(p)
+	}
+}
+
+// idempotencyDigest identifies what a request asks for, so a key cannot be
+// reused for a different message, options, timeout or callback.
+func idempotencyDigest(message string, opts runOptions) [sha256.Size]byte {
+	options, _ := json.Marshal(opts.options)
+	h := sha256.New()
+	for _, part := range []string{message, string(options), strconv.Itoa(opts.timeoutSeconds), opts.callbackURL} {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return digest
+}
+
+// idempotencyStore remembers successful replies per session and idempotency
+// key for a TTL, and the runs still executing.
+type idempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*idempotentRun
+	swept   time.Time
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, now: time.Now, entries: make(map[string]*idempotentRun)}
+}
+
+// begin returns the run for key and whether it is new, still running or a
+// cached reply. Reusing a key for a different request is an error.
+func (st *idempotencyStore) begin(key string, digest [sha256.Size]byte) (*idempotentRun, string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	if now.Sub(st.swept) >= st.ttl {
+		for k, run := range st.entries {
+			if !run.expires.IsZero() && now.After(run.expires) {
+				delete(st.entries, k)
+			}
+		}
+		st.swept = now
+	}
+
+	if run, ok := st.entries[key]; ok && (run.expires.IsZero() || now.Before(run.expires)) {
+		if run.digest != digest {
+			return nil, "", &messageError{Status: http.StatusUnprocessableEntity, Code: "IDEMPOTENCY_KEY_REUSED", Message: "idempotencyKey was already used for a different request"}
+		}
+		if run.expires.IsZero() {
+			return run, idempotencyAttached, nil
+		}
+		return run, idempotencyCached, nil
+	}
+
+	run := &idempotentRun{digest: digest, done: make(chan struct{})}
+	st.entries[key] = run
+	return run, idempotencyNew, nil
+}
+
+// finish publishes the outcome. Only replies are kept; after a failure the
+// key may run again.
+func (st *idempotencyStore) finish(key string, run *idempotentRun, result string, err error) {
+	st.mu.Lock()
+	run.result, run.err = result, err
+	if err == nil {
+		run.expires = st.now().Add(st.ttl)
+	} else if st.entries[key] == run {
+		delete(st.entries, key)
+	}
+	st.mu.Unlock()
+
+	run.mu.Lock()
+	run.status, run.output = "", nil
+	run.mu.Unlock()
+	close(run.done)
+}
+
+// WithIdempotencyTTL sets how long replies to requests with an
+// idempotencyKey are remembered.
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			s.idempotency.ttl = ttl
+		}
+	}
+}
+
+// runIdempotent runs the message once per session and key. The run is
+// detached from the first caller, so a client that reconnects and resends
+// attaches to it instead of starting another, and sees its progress.
+func (s *Server) runIdempotent(ctx context.Context, claims *auth.Claims, deviceID, message string, opts runOptions) (string, error) {
+	if len(opts.idempotencyKey) > maxIdempotencyKeyLen {
+		return "", &messageError{Status: http.StatusBadRequest, Code: "INVALID_REQUEST", Message: "idempotencyKey is too long"}
+	}
+
+	key := sessionID(claims, deviceID) + "\x00" + opts.idempotencyKey
+	run, outcome, err := s.idempotency.begin(key, idempotencyDigest(message, opts))
+	if err != nil {
+		log.Printf("[server] message rejected: idempotency key reused session_id=%s", deviceID)
+		return "", err
+	}
+	stop := run.watch(opts)
+	if outcome == idempotencyNew {
+		runOpts := opts
+		runOpts.progress, runOpts.output = run.progress, run.chunk
+		go func() {
+			result, err := s.runOnce(context.WithoutCancel(ctx), claims, deviceID, message, runOpts)
+			s.idempotency.finish(key, run, result, err)
+		}()
+	} else {
+		log.Printf("[server] idempotent request %s session_id=%s", outcome, deviceID)
+		s.metrics.Inc("clawproxy_idempotent_requests_total", "outcome", outcome)
+	}
+
+	select {
+	case <-run.done:
+		stop(true)
+		return run.result, run.err
+	case <-ctx.Done():
+		stop(false)
+		return "", contextError(ctx.Err())
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+// countingExecutor numbers its replies and blocks each run until release is
+// closed, when set.
+type countingExecutor struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (e *countingExecutor) Run(_ context.Context, _, _ string) (string, error) {
+	n := e.calls.Add(1)
+	if e.started != nil {
+		e.started <- struct{}{}
+	}
+	if e.release != nil {
+		<-e.release
+	}
+	if e.err != nil {
+		return "", e.err
+	}
+	return fmt.Sprintf(`{"run":%d}`, n), nil
+}
+
+func postWithKey(t *testing.T, r http.Handler, deviceID, key, message string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doJSON(t, r, http.MethodPost, "/v1/devices/"+deviceID+"/messages", mustCreateToken(t), messageRequest{Message: message, IdempotencyKey: key})
+}
+
+func TestIdempotency_ReturnsStoredReply(t *testing.T) {
+	exec := &countingExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	r := srv.Engine()
+
+	first := postWithKey(t, r, "device-1", "k1", "hello")
+	second := postWithKey(t, r, "device-1", "k1", "hello")
+	other := postWithKey(t, r, "device-1", "k2", "hello")
+	if first.Body.String() != `{"run":1}` || second.Body.String() != `{"run":1}` || other.Body.String() != `{"run":2}` {
+		t.Fatalf("unexpected replies: %s %s %s", first.Body.String(), second.Body.String(), other.Body.String())
+	}
+	if got := srv.metrics.Value("clawproxy_idempotent_requests_total", "outcome", idempotencyCached); got != 1 {
+		t.Fatalf("expected one cached request, got %v", got)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/devices/device-1/messages", strings.NewReader(`{"message":"hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+mustCreateToken(t))
+	req.Header.Set("Idempotency-Key", "k1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != `{"run":1}` || exec.calls.Load() != 2 {
+		t.Fatalf("expected the Idempotency-Key header to reuse the reply, got %s after %d runs", w.Body.String(), exec.calls.Load())
+	}
+}
+
+func TestIdempotency_AttachesToRunningRun(t *testing.T) {
+	exec := &countingExecutor{started: make(chan struct{}, 2), release: make(chan struct{})}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	r := srv.Engine()
+
+	var wg sync.WaitGroup
+	replies := make([]string, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		replies[0] = postWithKey(t, r, "device-1", "k1", "hello").Body.String()
+	}()
+	<-exec.started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		replies[1] = postWithKey(t, r, "device-1", "k1", "hello").Body.String()
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.metrics.Value("clawproxy_idempotent_requests_total", "outcome", idempotencyAttached) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("second request did not attach to the running run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(exec.release)
+	wg.Wait()
+
+	if replies[0] != `{"run":1}` || replies[1] != `{"run":1}` || exec.calls.Load() != 1 {
+		t.Fatalf("expected one shared run, got %v after %d runs", replies, exec.calls.Load())
+	}
+}
+
+func TestIdempotency_KeyReusedForOtherMessage(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &countingExecutor{})
+	r := srv.Engine()
+
+	postWithKey(t, r, "device-1", "k1", "hello")
+	w := postWithKey(t, r, "device-1", "k1", "goodbye")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if code := decodeErrorCode(t, w.Body.Bytes()); code != "IDEMPOTENCY_KEY_REUSED" {
+		t.Fatalf("expected code IDEMPOTENCY_KEY_REUSED, got %s", code)
+	}
+}
+
+func TestIdempotency_KeyReusedForOtherOptions(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &countingExecutor{})
+	r := srv.Engine()
+
+	postWithKey(t, r, "device-1", "k1", "hello")
+	w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hello", IdempotencyKey: "k1", TimeoutSeconds: 5})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+
+	base := idempotencyDigest("hello", runOptions{})
+	for name, opts := range map[string]runOptions{
+		"options":  {options: map[string]any{"model": "fast"}},
+		"callback": {callbackURL: "https://example.com/hook"},
+	} {
+		if idempotencyDigest("hello", opts) == base {
+			t.Fatalf("%s: expected a different digest", name)
+		}
+	}
+}
+
+// gatedStreamExecutor streams "a", waits for release, then streams "b".
+type gatedStreamExecutor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *gatedStreamExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e *gatedStreamExecutor) RunStream(_ context.Context, _, _ string, onOutput func([]byte)) (string, error) {
+	if onOutput != nil {
+		onOutput([]byte("a"))
+	}
+	close(e.started)
+	<-e.release
+	if onOutput != nil {
+		onOutput([]byte("b"))
+	}
+	return `{"ok":true}`, nil
+}
+
+func TestIdempotency_AttachedRequestSeesProgress(t *testing.T) {
+	exec := &gatedStreamExecutor{started: make(chan struct{}), release: make(chan struct{})}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	claims := &auth.Claims{Subject: "device-1"}
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := srv.runMessage(context.Background(), claims, "device-1", "hello", runOptions{idempotencyKey: "k1"})
+		first <- err
+	}()
+	<-exec.started
+
+	var mu sync.Mutex
+	var statuses []string
+	var output strings.Builder
+	opts := runOptions{
+		idempotencyKey: "k1",
+		progress: func(status string) {
+			mu.Lock()
+			statuses = append(statuses, status)
+			mu.Unlock()
+		},
+		output: func(chunk []byte) {
+			mu.Lock()
+			output.Write(chunk)
+			mu.Unlock()
+		},
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(exec.release) })
+	result, err := srv.runMessage(context.Background(), claims, "device-1", "hello", opts)
+	if err != nil || result != `{"ok":true}` {
+		t.Fatalf("unexpected attached result %q %v", result, err)
+	}
+	if err := <-first; err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if output.String() != "ab" || len(statuses) == 0 || statuses[len(statuses)-1] != messageRunning {
+		t.Fatalf("expected replayed and live progress, got statuses=%v output=%q", statuses, output.String())
+	}
+}
+
+func TestIdempotency_StalledWatcherDoesNotBlockRun(t *testing.T) {
+	run := &idempotentRun{done: make(chan struct{})}
+	stalled := make(chan struct{})
+	stopStalled := run.watch(runOptions{output: func([]byte) { <-stalled }})
+	var output strings.Builder
+	stop := run.watch(runOptions{output: func(p []byte) { output.Write(p) }})
+
+	chunked := make(chan struct{})
+	go func() {
+		buf := []byte("a")
+		run.chunk(buf)
+		buf[0] = 'b'
+		run.chunk(buf)
+		close(chunked)
+	}()
+	select {
+	case <-chunked:
+	case <-time.After(time.Second):
+		t.Fatal("expected a stalled watcher not to block the run's output")
+	}
+	stop(true)
+	if output.String() != "ab" {
+		t.Fatalf("expected the other watcher to get every chunk, got %q", output.String())
+	}
+
+	close(stalled)
+	stopStalled(false)
+}
+
+func TestIdempotency_FailuresAreNotStored(t *testing.T) {
+	exec := &countingExecutor{err: errors.New("exit status 1")}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	r := srv.Engine()
+
+	postWithKey(t, r, "device-1", "k1", "hello")
+	exec.err = nil
+	if w := postWithKey(t, r, "device-1", "k1", "hello"); w.Body.String() != `{"run":2}` {
+		t.Fatalf("expected the retry to run again, got %s", w.Body.String())
+	}
+}
+
+func TestIdempotencyStore_Expires(t *testing.T) {
+	st := newIdempotencyStore(time.Minute)
+	now := time.Now()
+	st.now = func() time.Time { return now }
+
+	run, _, _ := st.begin("dev-1\x00k1", idempotencyDigest("hello", runOptions{}))
+	st.finish("dev-1\x00k1", run, `{}`, nil)
+	if _, outcome, _ := st.begin("dev-1\x00k1", idempotencyDigest("hello", runOptions{})); outcome != idempotencyCached {
+		t.Fatalf("expected cached reply within the ttl, got %s", outcome)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, outcome, _ := st.begin("dev-1\x00k1", idempotencyDigest("goodbye", runOptions{})); outcome != idempotencyNew {
+		t.Fatalf("expected a new run after the ttl, got %s", outcome)
+	}
+}
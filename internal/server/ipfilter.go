@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter is a CIDR allow/deny list. Deny entries win; an empty allow list
+// allows every address that is not denied.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ParseCIDRs accepts CIDRs and bare addresses, which are treated as single hosts.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, raw := range values {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			ip := net.ParseIP(raw)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip or cidr: %q", raw)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip or cidr: %q", raw)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func (f *IPFilter) Allowed(rawIP string) bool {
+	ip := net.ParseIP(rawIP)
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
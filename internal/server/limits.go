@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"clawproxy/internal/auth"
+	"clawproxy/internal/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// deviceLimits resolves the limits for a caller: server defaults, overridden by
+// the tenant's limits, overridden by any limits carried in the token.
+func (s *Server) deviceLimits(claims *auth.Claims) ratelimit.Limits {
+	limits := s.limits
+	if t, ok := s.tenants[claims.Tenant]; ok && claims.Tenant != "" {
+		limits = limits.Override(t.cfg.Limits)
+	}
+
+	return limits.Override(ratelimit.Limits{
+		PerMinute:  claims.RatePerMinute,
+		Burst:      claims.RateBurst,
+		DailyQuota: claims.DailyQuota,
+	})
+}
+
+// allowMessage consumes one message from the session's rate limit and quota.
+func (s *Server) allowMessage(deviceID string, claims *auth.Claims) ratelimit.Decision {
+	decision := s.limiter.Allow(deviceID, s.deviceLimits(claims))
+	if !decision.Allowed {
+		s.metrics.Inc("clawproxy_rate_limited_total", "reason", decision.Reason)
+		log.Printf("[server] message rate limited session_id=%s reason=%s reset_at=%s", deviceID, decision.Reason, decision.ResetAt.UTC().Format(time.RFC3339))
+	}
+
+	return decision
+}
+
+func rateLimitMessage(decision ratelimit.Decision) string {
+	if decision.Reason == ratelimit.ReasonQuota {
+		return "daily message quota exceeded"
+	}
+
+	return "message rate limit exceeded"
+}
+
+func (s *Server) handleDeviceUsage(c *gin.Context) {
+	deviceID := c.Param("deviceId")
+	claims, ok := s.admitDevice(c, deviceID, "")
+	if !ok {
+		return
+	}
+
+	fallback := s.limits
+	if claims.Subject == deviceID {
+		fallback = s.deviceLimits(claims)
+	}
+	c.JSON(http.StatusOK, s.limiter.Usage(sessionID(claims, deviceID), fallback))
+}
+
+func (s *Server) handleListUsage(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"usage": s.limiter.List()})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clawproxy/internal/auth"
+	"clawproxy/internal/ratelimit"
+)
+
+func TestHandleWS_RateLimitedFrame(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec, WithLimits(ratelimit.Limits{PerMinute: 1, Burst: 1}))
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateToken(t))
+	defer conn.Close()
+
+	for _, msg := range []string{"first", "second"} {
+		if err := conn.WriteJSON(wsRequest{Message: msg}); err != nil {
+			t.Fatalf("write websocket message: %v", err)
+		}
+	}
+
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != `{"result":"ok"}` {
+		t.Fatalf("expected first message to succeed, got %q err=%v", message, err)
+	}
+
+	var resp wsError
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read rate limit frame: %v", err)
+	}
+	if resp.Code != "RATE_LIMITED" || resp.ResetAt <= time.Now().Unix() {
+		t.Fatalf("unexpected rate limit frame: %+v", resp)
+	}
+	if len(exec.gotMessages) != 1 {
+		t.Fatalf("expected executor to run once, got %#v", exec.gotMessages)
+	}
+}
+
+func TestHandleWS_TokenQuotaAndUsage(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	token, err := auth.SignToken([]byte(testJWTSecret), auth.Claims{Subject: "device-1", DailyQuota: 1})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, token)
+	defer conn.Close()
+
+	for _, msg := range []string{"first", "second"} {
+		if err := conn.WriteJSON(wsRequest{Message: msg}); err != nil {
+			t.Fatalf("write websocket message: %v", err)
+		}
+	}
+	_, _, _ = conn.ReadMessage()
+
+	var resp wsError
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read quota frame: %v", err)
+	}
+	if resp.Code != "RATE_LIMITED" || !strings.Contains(resp.Error, "quota") {
+		t.Fatalf("unexpected quota frame: %+v", resp)
+	}
+
+	w := doJSON(t, srv.Engine(), http.MethodGet, "/v1/devices/device-1/usage", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var usage ratelimit.Usage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("decode usage: %v", err)
+	}
+	if usage.Used != 1 || usage.DailyQuota != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+type AuthMode string
+
+const (
+	// AuthModeJWT accepts only bearer tokens and tickets.
+	AuthModeJWT AuthMode = "jwt"
+	// AuthModeMTLS accepts only verified client certificates.
+	AuthModeMTLS AuthMode = "mtls"
+	// AuthModeEither accepts a client certificate when presented and falls back to JWT.
+	AuthModeEither AuthMode = "either"
+	// AuthModeBoth requires a client certificate and a JWT for the same device.
+	AuthModeBoth AuthMode = "both"
+)
+
+const (
+	CertIdentityCN    = "cn"
+	CertIdentityDNS   = "dns"
+	CertIdentityURI   = "uri"
+	CertIdentityEmail = "email"
+)
+
+// ListenerConfig describes one address the server listens on and how clients
+// connecting through it authenticate.
+type ListenerConfig struct {
+	Addr     string   `json:"addr"`
+	TLSCert  string   `json:"tlsCert,omitempty"`
+	TLSKey   string   `json:"tlsKey,omitempty"`
+	ClientCA string   `json:"clientCA,omitempty"`
+	AuthMode AuthMode `json:"authMode,omitempty"`
+	// CertIdentity selects where the deviceId comes from in a client certificate.
+	CertIdentity string `json:"certIdentity,omitempty"`
+	// CertScopes are granted to clients authenticated by certificate alone.
+	CertScopes []string `json:"certScopes,omitempty"`
+	// ProxyProtocol expects a PROXY protocol v1/v2 header on every connection,
+	// for listeners behind L4 load balancers.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+}
+
+type listenerContextKey struct{}
+
+func (l ListenerConfig) mode() AuthMode {
+	if l.AuthMode == "" {
+		return AuthModeJWT
+	}
+
+	return l.AuthMode
+}
+
+func (l ListenerConfig) Validate() error {
+	if l.Addr == "" {
+		return fmt.Errorf("listener addr is required")
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return fmt.Errorf("listener %s: tls cert and key must be set together", l.Addr)
+	}
+
+	switch l.mode() {
+	case AuthModeJWT:
+	case AuthModeMTLS, AuthModeEither, AuthModeBoth:
+		if l.TLSCert == "" || l.ClientCA == "" {
+			return fmt.Errorf("listener %s: auth mode %q requires tls cert, key and client ca", l.Addr, l.mode())
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown auth mode %q", l.Addr, l.AuthMode)
+	}
+
+	switch l.CertIdentity {
+	case "", CertIdentityCN, CertIdentityDNS, CertIdentityURI, CertIdentityEmail:
+	default:
+		return fmt.Errorf("listener %s: unknown cert identity %q", l.Addr, l.CertIdentity)
+	}
+
+	if err := auth.ValidateScopes(l.CertScopes); err != nil {
+		return fmt.Errorf("listener %s: %w", l.Addr, err)
+	}
+
+	return nil
+}
+
+// tlsConfig builds the listener TLS config serving certificates from certs.
+func (l ListenerConfig) tlsConfig(certs *certReloader) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}
+
+	if l.ClientCA == "" {
+		return cfg, nil
+	}
+
+	caPEM, err := os.ReadFile(l.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("client ca %s contains no certificates", l.ClientCA)
+	}
+	cfg.ClientCAs = pool
+
+	switch l.mode() {
+	case AuthModeMTLS, AuthModeBoth:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// handler tags requests with the listener they arrived on so authentication
+// can apply its auth mode.
+func (l ListenerConfig) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, l)))
+	})
+}
+
+func requestListener(r *http.Request) ListenerConfig {
+	l, _ := r.Context().Value(listenerContextKey{}).(ListenerConfig)
+	return l
+}
+
+// certificateClaims builds claims from a verified client certificate, or returns
+// nil when the request carries none.
+func certificateClaims(r *http.Request, l ListenerConfig) *auth.Claims {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	deviceID := certificateDeviceID(cert, l.CertIdentity)
+	if deviceID == "" {
+		return nil
+	}
+
+	scopes := l.CertScopes
+	if len(scopes) == 0 {
+		scopes = auth.DefaultScopes
+	}
+	expiresAt := cert.NotAfter.Unix()
+
+	return &auth.Claims{
+		Subject:   deviceID,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: &expiresAt,
+		Scope:     strings.Join(scopes, " "),
+	}
+}
+
+func certificateDeviceID(cert *x509.Certificate, source string) string {
+	switch source {
+	case CertIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertIdentityURI:
+		if len(cert.URIs) > 0 {
+			u := cert.URIs[0]
+			if u.Opaque != "" {
+				return u.Opaque
+			}
+			return strings.TrimPrefix(u.Host+u.Path, "/")
+		}
+	case CertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
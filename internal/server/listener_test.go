@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testPKI struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+	dir    string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ca key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clawproxy test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse ca cert: %v", err)
+	}
+
+	p := &testPKI{caCert: cert, caKey: key, dir: t.TempDir()}
+	p.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	p.write(t, "ca.pem", p.caPEM)
+
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+
+	return path
+}
+
+// issue signs a leaf certificate and returns the PEM encoded cert and key.
+func (p *testPKI) issue(t *testing.T, commonName string, serial int64, server bool) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate leaf key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("create leaf cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal leaf key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (p *testPKI) clientTLS(t *testing.T, commonName string) *tls.Config {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(p.caPEM)
+	cfg := &tls.Config{RootCAs: pool}
+	if commonName == "" {
+		return cfg
+	}
+
+	certPEM, keyPEM := p.issue(t, commonName, 100, false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load client key pair: %v", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+
+	return cfg
+}
+
+func startTLSListener(t *testing.T, srv *Server, p *testPKI, mode AuthMode) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := p.issue(t, "clawproxy", 2, true)
+	l := ListenerConfig{
+		Addr:     "127.0.0.1:0",
+		TLSCert:  p.write(t, "server.pem", certPEM),
+		TLSKey:   p.write(t, "server-key.pem", keyPEM),
+		ClientCA: filepath.Join(p.dir, "ca.pem"),
+		AuthMode: mode,
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatalf("validate listener: %v", err)
+	}
+	certs, err := newCertReloader(l.TLSCert, l.TLSKey)
+	if err != nil {
+		t.Fatalf("load certificate: %v", err)
+	}
+	tlsConfig, err := l.tlsConfig(certs)
+	if err != nil {
+		t.Fatalf("build tls config: %v", err)
+	}
+
+	// StartTLS would install its own certificate, so wrap the listener instead.
+	ts := httptest.NewUnstartedServer(l.handler(srv.Engine()))
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Start()
+	ts.URL = strings.Replace(ts.URL, "http://", "https://", 1)
+	return ts
+}
+
+func TestListener_MTLSDerivesDeviceID(t *testing.T) {
+	p := newTestPKI(t)
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := startTLSListener(t, srv, p, AuthModeMTLS)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: p.clientTLS(t, "device-7")}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial websocket with client cert: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read websocket message: %v", err)
+	}
+	if exec.gotDeviceID != "device-7" {
+		t.Fatalf("expected deviceId from certificate, got %q", exec.gotDeviceID)
+	}
+}
+
+func TestListener_MTLSRejectsOtherDevice(t *testing.T) {
+	p := newTestPKI(t)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	ts := startTLSListener(t, srv, p, AuthModeMTLS)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: p.clientTLS(t, "device-7")}
+	_, resp, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws?deviceId=device-1", nil)
+	if err == nil {
+		t.Fatal("expected handshake failure for another device")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %+v", http.StatusForbidden, resp)
+	}
+}
+
+func TestListener_EitherFallsBackToJWT(t *testing.T) {
+	p := newTestPKI(t)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	ts := startTLSListener(t, srv, p, AuthModeEither)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: p.clientTLS(t, "")}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws?deviceId=device-1", http.Header{"Authorization": []string{mustCreateToken(t)}})
+	if err != nil {
+		t.Fatalf("dial websocket with jwt: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListener_BothRequiresMatchingIdentity(t *testing.T) {
+	p := newTestPKI(t)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	ts := startTLSListener(t, srv, p, AuthModeBoth)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: p.clientTLS(t, "device-7")}
+	_, resp, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws?deviceId=device-1", http.Header{"Authorization": []string{mustCreateToken(t)}})
+	if err == nil {
+		t.Fatal("expected handshake failure for mismatched identities")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %+v", http.StatusForbidden, resp)
+	}
+}
+
+func TestListenerConfig_Validate(t *testing.T) {
+	if err := (ListenerConfig{Addr: ":8443", AuthMode: AuthModeMTLS}).Validate(); err == nil {
+		t.Fatal("expected mtls without client ca to be rejected")
+	}
+	if err := (ListenerConfig{Addr: ":8443", AuthMode: "kerberos"}).Validate(); err == nil {
+		t.Fatal("expected unknown auth mode to be rejected")
+	}
+	if err := (ListenerConfig{Addr: ":8080"}).Validate(); err != nil {
+		t.Fatalf("expected plain jwt listener to be valid: %v", err)
+	}
+}
+
+func TestRun_ProxyProtocolRequiresTrustedProxies(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{}, WithListeners(ListenerConfig{Addr: "127.0.0.1:0", ProxyProtocol: true}))
+	if err := srv.Run(); err == nil || !strings.Contains(err.Error(), "trusted proxies") {
+		t.Fatalf("expected proxy protocol without trusted proxies to be refused, got %v", err)
+	}
+}
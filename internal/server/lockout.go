@@ -0,0 +1,179 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LockoutConfig controls the exponential lockout applied after repeated
+// authentication failures from one IP or for one deviceId.
+type LockoutConfig struct {
+	// Threshold is the number of consecutive failures before the first lockout.
+	Threshold int
+	// BaseDelay is the first lockout; each further failure doubles it.
+	BaseDelay time.Duration
+	// MaxDelay caps the lockout and is also how long failures are remembered.
+	MaxDelay time.Duration
+}
+
+var DefaultLockoutConfig = LockoutConfig{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+
+type lockoutEntry struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+type lockoutTracker struct {
+	cfg LockoutConfig
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+func newLockoutTracker(cfg LockoutConfig) *lockoutTracker {
+	return &lockoutTracker{cfg: cfg, entries: make(map[string]*lockoutEntry)}
+}
+
+// retryAfter returns how long the longest lockout among keys still lasts.
+func (t *lockoutTracker) retryAfter(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var longest time.Duration
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if wait := entry.LockedUntil.Sub(now); wait > longest {
+			longest = wait
+		}
+	}
+
+	return longest
+}
+
+func (t *lockoutTracker) fail(keys ...string) {
+	if t.cfg.Threshold <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.pruneLocked(now)
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			entry = &lockoutEntry{Key: key}
+			t.entries[key] = entry
+		}
+		entry.Failures++
+		entry.LastFailure = now
+
+		if over := entry.Failures - t.cfg.Threshold; over >= 0 {
+			delay := time.Duration(float64(t.cfg.BaseDelay) * math.Pow(2, float64(over)))
+			if delay <= 0 || delay > t.cfg.MaxDelay {
+				delay = t.cfg.MaxDelay
+			}
+			entry.LockedUntil = now.Add(delay)
+		}
+	}
+}
+
+func (t *lockoutTracker) reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+func (t *lockoutTracker) list() []lockoutEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pruneLocked(time.Now())
+	list := make([]lockoutEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list
+}
+
+// pruneLocked forgets entries whose lockout ended and whose last failure is
+// older than MaxDelay.
+func (t *lockoutTracker) pruneLocked(now time.Time) {
+	for key, entry := range t.entries {
+		if now.After(entry.LockedUntil) && now.Sub(entry.LastFailure) > t.cfg.MaxDelay {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func lockoutKeys(clientIP, deviceID string) []string {
+	keys := []string{"ip:" + clientIP}
+	if deviceID != "" {
+		keys = append(keys, "device:"+deviceID)
+	}
+
+	return keys
+}
+
+// rejectLockedOut writes a 429 when any of keys is locked out.
+func (s *Server) rejectLockedOut(c *gin.Context, keys ...string) bool {
+	wait := s.lockouts.retryAfter(keys...)
+	if wait <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	s.metrics.Inc("clawproxy_auth_lockout_rejected_total")
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"code": "LOCKED_OUT", "error": "too many failed attempts", "retryAfter": seconds})
+	return true
+}
+
+// recordAuthResult updates failure counters after an authentication attempt.
+// Only credential failures count; scope and device mismatches do not. Success
+// clears device counters but not IP counters, so one valid token cannot be
+// used to keep resetting an IP that is guessing other devices' credentials.
+func (s *Server) recordAuthResult(c *gin.Context, ok bool, keys ...string) {
+	if ok {
+		for _, key := range keys {
+			if strings.HasPrefix(key, "device:") {
+				s.lockouts.reset(key)
+			}
+		}
+		return
+	}
+	if c.Writer.Status() != http.StatusUnauthorized {
+		return
+	}
+
+	s.metrics.Inc("clawproxy_auth_failures_total")
+	s.lockouts.fail(keys...)
+}
+
+func (s *Server) handleListLockouts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"lockouts": s.lockouts.list()})
+}
+
+func (s *Server) handleClearLockout(c *gin.Context) {
+	s.lockouts.reset(c.Param("key"))
+	c.JSON(http.StatusOK, gin.H{"key": c.Param("key"), "status": "cleared"})
+}
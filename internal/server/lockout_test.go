@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutTracker_ExponentialBackoff(t *testing.T) {
+	tracker := newLockoutTracker(LockoutConfig{Threshold: 2, BaseDelay: time.Minute, MaxDelay: 3 * time.Minute})
+
+	tracker.fail("ip:10.0.0.1")
+	if wait := tracker.retryAfter("ip:10.0.0.1"); wait != 0 {
+		t.Fatalf("expected no lockout below threshold, got %s", wait)
+	}
+
+	tracker.fail("ip:10.0.0.1")
+	if wait := tracker.retryAfter("ip:10.0.0.1"); wait <= 50*time.Second || wait > time.Minute {
+		t.Fatalf("expected ~1m lockout, got %s", wait)
+	}
+
+	tracker.fail("ip:10.0.0.1")
+	if wait := tracker.retryAfter("ip:10.0.0.1"); wait <= 110*time.Second || wait > 2*time.Minute {
+		t.Fatalf("expected ~2m lockout, got %s", wait)
+	}
+
+	tracker.fail("ip:10.0.0.1")
+	tracker.fail("ip:10.0.0.1")
+	if wait := tracker.retryAfter("ip:10.0.0.1"); wait > 3*time.Minute {
+		t.Fatalf("expected lockout capped at 3m, got %s", wait)
+	}
+
+	tracker.reset("ip:10.0.0.1")
+	if wait := tracker.retryAfter("ip:10.0.0.1"); wait != 0 {
+		t.Fatalf("expected reset to clear lockout, got %s", wait)
+	}
+}
+
+func TestHandleWS_LockoutAfterFailures(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{}, WithLockout(LockoutConfig{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour}))
+	r := srv.Engine()
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ws?deviceId=device-1", nil)
+		req.Header.Set("Authorization", "bad-token")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status %d, got %d", i, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?deviceId=device-1", nil)
+	req.Header.Set("Authorization", mustCreateToken(t))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+	if !strings.Contains(w.Body.String(), "LOCKED_OUT") {
+		t.Fatalf("unexpected response body: %s", w.Body.String())
+	}
+
+	w = doJSON(t, r, http.MethodGet, "/v1/admin/lockouts", mustCreateAdminToken(t), nil)
+	var resp struct {
+		Lockouts []lockoutEntry `json:"lockouts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode lockouts: %v", err)
+	}
+	if len(resp.Lockouts) != 2 {
+		t.Fatalf("expected ip and device lockouts, got %+v", resp.Lockouts)
+	}
+
+	for _, entry := range resp.Lockouts {
+		if w := doJSON(t, r, http.MethodDelete, "/v1/admin/lockouts/"+entry.Key, mustCreateAdminToken(t), nil); w.Code != http.StatusOK {
+			t.Fatalf("clear lockout %s: status %d", entry.Key, w.Code)
+		}
+	}
+	if wait := srv.lockouts.retryAfter(lockoutKeys("192.0.2.1", "device-1")...); wait != 0 {
+		t.Fatalf("expected lockouts cleared, got %s", wait)
+	}
+}
+
+func TestHandleWS_DeniedCIDR(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("parse ip filter: %v", err)
+	}
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{}, WithIPFilter(filter))
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?deviceId=device-1", nil)
+	w := httptest.NewRecorder()
+	srv.Engine().ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "IP_NOT_ALLOWED") {
+		t.Fatalf("expected IP_NOT_ALLOWED, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = doJSON(t, srv.Engine(), http.MethodGet, "/v1/devices/device-1/usage", mustCreateToken(t), nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "IP_NOT_ALLOWED") {
+		t.Fatalf("expected the usage endpoint to apply the filter, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::1"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("parse ip filter: %v", err)
+	}
+
+	cases := map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.3.4":    false,
+		"172.16.0.1":  false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	}
+	for ip, want := range cases {
+		if got := filter.Allowed(ip); got != want {
+			t.Fatalf("ip %s: expected %v, got %v", ip, want, got)
+		}
+	}
+
+	if _, err := NewIPFilter([]string{"not-a-cidr"}, nil); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
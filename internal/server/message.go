@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// messageError is a failed message run, carrying how HTTP endpoints report it.
+type messageError struct {
+	Status  int
+	Code    string
+	Message string
+	ResetAt time.Time
+	// Output is the command's partial stdout when it timed out.
+	Output string
+	Err    error
+}
+
+func (e *messageError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+
+	return e.Message
+}
+
+func (e *messageError) Unwrap() error {
+	return e.Err
+}
+
+// frame renders the error as a websocket error frame.
+func (e *messageError) frame() wsError {
+	frame := wsError{Type: "error", Code: e.Code, Error: e.Message}
+	if !e.ResetAt.IsZero() {
+		frame.ResetAt = e.ResetAt.Unix()
+	}
+	frame.Output = e.Output
+
+	return frame
+}
+
+// sessionLocks serializes executor runs per session across every transport, so
+// one device's messages reach openclaw one at a time.
+type sessionLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+type sessionLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func newSessionLocks() *sessionLocks {
+	return &sessionLocks{locks: make(map[string]*sessionLock)}
+}
+
+// lock waits for the session's turn and returns the function releasing it.
+func (l *sessionLocks) lock(ctx context.Context, key string) (func(), error) {
+	l.mu.Lock()
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &sessionLock{ch: make(chan struct{}, 1)}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+
+	select {
+	case entry.ch <- struct{}{}:
+		return func() {
+			<-entry.ch
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// Progress statuses reported through runOptions.
+const (
+	messageQueued  = "queued"
+	messageRunning = "running"
+)
+
+// runOptions tunes one runMessage call; the zero value is a plain run. Nil
+// callbacks are skipped.
+type runOptions struct {
+	progress func(status string)
+	// output receives stdout chunks when the executor is a StreamingExecutor.
+	output func([]byte)
+	// callbackURL receives the result as a webhook, besides the device's own.
+	callbackURL string
+	// options is the request's options object, checked against the allowlist.
+	options map[string]any
+	// timeoutSeconds is the request's timeout; zero uses the device default.
+	timeoutSeconds int
+	// idempotencyKey makes resends of the message reuse the first run.
+	idempotencyKey string
+}
+
+// runMessage is the pipeline shared by /ws and the HTTP message endpoints: it
+// applies the device's limits, waits for the session's turn, runs the executor
+// and extracts the JSON reply, then hands the outcome to any webhooks. Requests
+// with an idempotency key share one run per key.
+func (s *Server) runMessage(ctx context.Context, claims *auth.Claims, deviceID, message string, opts runOptions) (string, error) {
+	if opts.idempotencyKey != "" {
+		return s.runIdempotent(ctx, claims, deviceID, message, opts)
+	}
+
+	return s.runOnce(ctx, claims, deviceID, message, opts)
+}
+
+func (s *Server) runOnce(ctx context.Context, claims *auth.Claims, deviceID, message string, opts runOptions) (string, error) {
+	jsonPayload, err := s.executeMessage(ctx, claims, deviceID, message, opts)
+	s.notifyResult(claims, deviceID, opts.callbackURL, jsonPayload, err)
+	return jsonPayload, err
+}
+
+func (s *Server) executeMessage(ctx context.Context, claims *auth.Claims, deviceID, message string, opts runOptions) (string, error) {
+	key := sessionID(claims, deviceID)
+	optionArgs, err := s.optionArgs(claims, opts.options)
+	if err != nil {
+		log.Printf("[server] message rejected: invalid options session_id=%s err=%v", deviceID, err)
+		return "", err
+	}
+	timeout, err := s.runTimeout(claims, key, opts.timeoutSeconds)
+	if err != nil {
+		log.Printf("[server] message rejected: invalid timeout session_id=%s timeout_seconds=%d", deviceID, opts.timeoutSeconds)
+		return "", err
+	}
+	if decision := s.allowMessage(key, claims); !decision.Allowed {
+		return "", &messageError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED", Message: rateLimitMessage(decision), ResetAt: decision.ResetAt}
+	}
+
+	opts.report(messageQueued)
+	unlock, err := s.sessions.lock(ctx, key)
+	if err != nil {
+		return "", contextError(err)
+	}
+	defer unlock()
+	opts.report(messageRunning)
+
+	runCtx := withKillGrace(withOptionArgs(withCallerClaims(ctx, claims), optionArgs), s.timeouts.grace())
+	if timeout < s.deviceTimeout(key) {
+		runCtx = withShortenedTimeout(runCtx)
+	}
+	runCtx, cancel := context.WithTimeout(runCtx, timeout)
+	defer cancel()
+	output, runErr := runExecutor(runCtx, s.executorFor(claims), key, message, opts.output)
+
+	if output != "" {
+		log.Printf("[server] full command output session_id=%s: %s", deviceID, output)
+	}
+
+	if runErr != nil {
+		log.Printf("[server] executor failed session_id=%s err=%v", deviceID, runErr)
+		if ctxErr := runCtx.Err(); ctxErr != nil {
+			msgErr := contextError(ctxErr)
+			if msgErr.Code == "TIMEOUT" {
+				msgErr.Output = output
+			}
+			return "", msgErr
+		}
+		// Executors that know better, like HTTPExecutor, report their own codes.
+		var msgErr *messageError
+		if errors.As(runErr, &msgErr) {
+			return "", msgErr
+		}
+		return "", &messageError{Status: http.StatusBadGateway, Code: "EXECUTOR_FAILED", Message: "agent command failed", Err: runErr}
+	}
+
+	jsonPayload, extractErr := extractJSONObject(output)
+	if extractErr != nil {
+		log.Printf("[server] failed to extract json from output session_id=%s err=%v", deviceID, extractErr)
+		return "", &messageError{Status: http.StatusBadGateway, Code: "INVALID_OUTPUT", Message: "agent returned no json object", Err: extractErr}
+	}
+
+	return jsonPayload, nil
+}
+
+func (o runOptions) report(status string) {
+	if o.progress != nil {
+		o.progress(status)
+	}
+}
+
+func contextError(err error) *messageError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &messageError{Status: http.StatusGatewayTimeout, Code: "TIMEOUT", Message: "agent did not respond in time", Err: err}
+	}
+
+	return &messageError{Status: http.StatusServiceUnavailable, Code: "CANCELED", Message: "request canceled", Err: err}
+}
+
+func asMessageError(err error) *messageError {
+	var msgErr *messageError
+	if errors.As(err, &msgErr) {
+		return msgErr
+	}
+
+	return &messageError{Status: http.StatusInternalServerError, Code: "INTERNAL_ERROR", Message: "message failed", Err: err}
+}
+
+func writeMessageError(c *gin.Context, err error) {
+	msgErr := asMessageError(err)
+	body := gin.H{"code": msgErr.Code, "error": msgErr.Message}
+	if !msgErr.ResetAt.IsZero() {
+		setRetryAfter(c, msgErr.ResetAt)
+		body["resetAt"] = msgErr.ResetAt.Unix()
+	}
+	if msgErr.Output != "" {
+		body["output"] = msgErr.Output
+	}
+	c.JSON(msgErr.Status, body)
+}
+
+// setRetryAfter tells the client when to try again, if resetAt is set.
+func setRetryAfter(c *gin.Context, resetAt time.Time) {
+	if !resetAt.IsZero() {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(resetAt).Seconds()))))
+	}
+}
+
+// admitDevice applies the /ws handshake checks to a device request: client
+// CIDR lists, origin allowlist, lockouts, then token or ticket authentication.
+func (s *Server) admitDevice(c *gin.Context, deviceID, scope string) (*auth.Claims, bool) {
+	clientIP := c.ClientIP()
+	if !s.ipFilter.Allowed(clientIP) {
+		log.Printf("[server] reject request: ip not allowed path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, clientIP)
+		s.metrics.Inc("clawproxy_ws_ip_rejected_total")
+		c.JSON(http.StatusForbidden, gin.H{"code": "IP_NOT_ALLOWED", "error": "client address is not allowed"})
+		return nil, false
+	}
+	if !s.origins.Allowed(c.Request) {
+		log.Printf("[server] reject request: origin not allowed path=%s session_id=%s client_ip=%s origin=%q", c.FullPath(), deviceID, clientIP, c.GetHeader("Origin"))
+		s.metrics.Inc("clawproxy_ws_origin_rejected_total")
+		c.JSON(http.StatusForbidden, gin.H{"code": "ORIGIN_NOT_ALLOWED", "error": "origin is not allowed"})
+		return nil, false
+	}
+	lockKeys := lockoutKeys(clientIP, deviceID)
+	if s.rejectLockedOut(c, lockKeys...) {
+		log.Printf("[server] reject request: locked out path=%s session_id=%s client_ip=%s", c.FullPath(), deviceID, clientIP)
+		return nil, false
+	}
+
+	credential := s.tokenClaims
+	if ticket := c.Query("ticket"); ticket != "" {
+		credential = s.ticketClaims(ticket)
+	}
+	claims, ok := s.identify(c, deviceID, credential)
+	s.recordAuthResult(c, ok, lockKeys...)
+	if !ok || !s.authorize(c, claims, deviceID, scope) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+type messageRequest struct {
+	Message     string         `json:"message"`
+	CallbackURL string         `json:"callbackUrl,omitempty"`
+	Options     map[string]any `json:"options,omitempty"`
+	// TimeoutSeconds asks for a timeout other than the default.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// IdempotencyKey may also be sent as the Idempotency-Key header.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// bindMessageRequest reads a messageRequest body, taking the idempotency key
+// from the header when the body has none.
+func bindMessageRequest(c *gin.Context) (messageRequest, bool) {
+	var req messageRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Message == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": "message is required"})
+		return req, false
+	}
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = c.GetHeader("Idempotency-Key")
+	}
+
+	return req, true
+}
+
+func (r messageRequest) runOptions() runOptions {
+	return runOptions{callbackURL: r.CallbackURL, options: r.Options, timeoutSeconds: r.TimeoutSeconds, idempotencyKey: r.IdempotencyKey}
+}
+
+// handleDeviceMessage runs one message without a websocket and returns the
+// agent's JSON reply. With a callbackUrl it answers 202 at once and the reply
+// is delivered by webhook instead.
+func (s *Server) handleDeviceMessage(c *gin.Context) {
+	deviceID := c.Param("deviceId")
+	claims, ok := s.admitDevice(c, deviceID, auth.ScopeChat)
+	if !ok {
+		return
+	}
+
+	req, ok := bindMessageRequest(c)
+	if !ok {
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := s.checkCallbackURL(claims, req.CallbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": err.Error()})
+			return
+		}
+		if _, err := s.optionArgs(claims, req.Options); err != nil {
+			writeMessageError(c, err)
+			return
+		}
+		if _, err := s.runTimeout(claims, sessionID(claims, deviceID), req.TimeoutSeconds); err != nil {
+			writeMessageError(c, err)
+			return
+		}
+	}
+
+	log.Printf("[server] received http message session_id=%s message_len=%d callback=%t", deviceID, len(req.Message), req.CallbackURL != "")
+	if req.CallbackURL != "" {
+		go func() {
+			if _, err := s.runMessage(context.WithoutCancel(c.Request.Context()), claims, deviceID, req.Message, req.runOptions()); err != nil {
+				s.notifyRefused(claims, deviceID, req.CallbackURL, err)
+			}
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
+		return
+	}
+
+	jsonPayload, err := s.runMessage(c.Request.Context(), claims, deviceID, req.Message, req.runOptions())
+	if err != nil {
+		writeMessageError(c, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(jsonPayload))
+}
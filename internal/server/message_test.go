@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clawproxy/internal/ratelimit"
+)
+
+func TestDeviceMessage_ReturnsExtractedJSON(t *testing.T) {
+	exec := &fakeExecutor{output: "thinking...\n{\"result\":\"ok\"}\n"}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hello"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Body.String() != `{"result":"ok"}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+	if exec.gotDeviceID != "device-1" || len(exec.gotMessages) != 1 || exec.gotMessages[0] != "hello" {
+		t.Fatalf("unexpected executor call: device=%q messages=%v", exec.gotDeviceID, exec.gotMessages)
+	}
+}
+
+func TestDeviceMessage_FailureStatuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		exec   *fakeExecutor
+		body   any
+		status int
+		code   string
+	}{
+		{name: "missing message", exec: &fakeExecutor{}, body: messageRequest{}, status: http.StatusBadRequest, code: "INVALID_REQUEST"},
+		{name: "executor error", exec: &fakeExecutor{err: errors.New("exit status 1")}, body: messageRequest{Message: "hi"}, status: http.StatusBadGateway, code: "EXECUTOR_FAILED"},
+		{name: "no json", exec: &fakeExecutor{output: "plain text"}, body: messageRequest{Message: "hi"}, status: http.StatusBadGateway, code: "INVALID_OUTPUT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewWithExecutor(":0", testJWTSecret, tt.exec)
+			w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d body=%s", tt.status, w.Code, w.Body.String())
+			}
+			if code := decodeErrorCode(t, w.Body.Bytes()); code != tt.code {
+				t.Fatalf("expected code %s, got %s", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestDeviceMessage_RateLimited(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{}`}, WithLimits(ratelimit.Limits{PerMinute: 1, Burst: 1}))
+	r := srv.Engine()
+	token := mustCreateToken(t)
+
+	doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", token, messageRequest{Message: "first"})
+	w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", token, messageRequest{Message: "second"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+	if code := decodeErrorCode(t, w.Body.Bytes()); code != "RATE_LIMITED" {
+		t.Fatalf("expected code RATE_LIMITED, got %s", code)
+	}
+}
+
+func TestDeviceMessage_RequiresOwnDevice(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-2/messages", mustCreateToken(t), messageRequest{Message: "hi"})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func decodeErrorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+
+	return resp.Code
+}
+
+type concurrencyExecutor struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (e *concurrencyExecutor) Run(_ context.Context, _, _ string) (string, error) {
+	n := e.running.Add(1)
+	defer e.running.Add(-1)
+	if n > e.peak.Load() {
+		e.peak.Store(n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	return `{"result":"ok"}`, nil
+}
+
+func TestDeviceMessage_SerializedPerDevice(t *testing.T) {
+	exec := &concurrencyExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	r := srv.Engine()
+	token := mustCreateToken(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", token, messageRequest{Message: "hi"}); w.Code != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := exec.peak.Load(); peak != 1 {
+		t.Fatalf("expected one run at a time per device, got %d", peak)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// chatSessionHeader names the session when the request has no user field.
+const chatSessionHeader = "X-Session-Id"
+
+const defaultChatModel = "openclaw"
+
+// replyFields are the top-level string fields, in order of preference, taken
+// as the assistant's reply from the agent's JSON output.
+var replyFields = []string{"reply", "text", "content", "message", "output", "result"}
+
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// text returns the message content, which is either a string or an array of
+// content parts of which only text parts are kept.
+func (m chatMessage) text() string {
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		return s
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return ""
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+type chatCompletionRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	User     string        `json:"user"`
+}
+
+type chatResponseMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int                  `json:"index"`
+	Message      *chatResponseMessage `json:"message,omitempty"`
+	Delta        *chatResponseMessage `json:"delta,omitempty"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+}
+
+func openAIError(c *gin.Context, status int, errType, code, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"message": message, "type": errType, "code": code}})
+}
+
+// openAIErrorType maps a status to the error type OpenAI clients base their
+// retries on.
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "server_error"
+	}
+}
+
+// chatReply maps the agent's JSON output to the assistant message content.
+func chatReply(jsonPayload string) string {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(jsonPayload), &obj); err == nil {
+		for _, field := range replyFields {
+			if s, ok := obj[field].(string); ok {
+				return s
+			}
+		}
+	}
+
+	return jsonPayload
+}
+
+func newCompletionID() string {
+	raw := make([]byte, 12)
+	_, _ = rand.Read(raw)
+	return "chatcmpl-" + hex.EncodeToString(raw)
+}
+
+// handleChatCompletions is an OpenAI Chat Completions facade: the last user
+// message goes to openclaw and the reply comes back as choices[0].message.
+func (s *Server) handleChatCompletions(c *gin.Context) {
+	var req chatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "INVALID_REQUEST", "invalid json body")
+		return
+	}
+	message := ""
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			message = req.Messages[i].text()
+			break
+		}
+	}
+	if message == "" {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "INVALID_REQUEST", "a user message is required")
+		return
+	}
+	if req.Model == "" {
+		req.Model = defaultChatModel
+	}
+
+	deviceID := req.User
+	if deviceID == "" {
+		deviceID = c.GetHeader(chatSessionHeader)
+	}
+	claims, ok := s.admitDevice(c, deviceID, auth.ScopeChat)
+	if !ok {
+		return
+	}
+	if deviceID == "" {
+		deviceID = claims.Subject
+	}
+
+	completion := chatCompletion{ID: newCompletionID(), Created: time.Now().Unix(), Model: req.Model}
+	log.Printf("[server] received chat completion session_id=%s message_len=%d stream=%t", deviceID, len(message), req.Stream)
+	if req.Stream {
+		s.streamChatCompletion(c, completion, claims, deviceID, message)
+		return
+	}
+
+	jsonPayload, err := s.runMessage(c.Request.Context(), claims, deviceID, message, runOptions{})
+	if err != nil {
+		msgErr := asMessageError(err)
+		setRetryAfter(c, msgErr.ResetAt)
+		openAIError(c, msgErr.Status, openAIErrorType(msgErr.Status), msgErr.Code, msgErr.Message)
+		return
+	}
+
+	stop := "stop"
+	completion.Object = "chat.completion"
+	completion.Choices = []chatChoice{{
+		Message:      &chatResponseMessage{Role: "assistant", Content: chatReply(jsonPayload)},
+		FinishReason: &stop,
+	}}
+	c.JSON(http.StatusOK, completion)
+}
+
+// streamChatCompletion answers stream: true requests with chat.completion.chunk
+// events. openclaw's raw stdout is not the reply, so the content arrives as one
+// delta once the run finishes; keepalive comments cover the wait.
+func (s *Server) streamChatCompletion(c *gin.Context, completion chatCompletion, claims *auth.Claims, deviceID, message string) {
+	type result struct {
+		payload string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		payload, err := s.runMessage(c.Request.Context(), claims, deviceID, message, runOptions{})
+		done <- result{payload, err}
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	completion.Object = "chat.completion.chunk"
+	writeChunk := func(v any) bool {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("[server] marshal chat completion chunk failed session_id=%s err=%v", deviceID, err)
+			return false
+		}
+		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+			log.Printf("[server] write chat completion chunk failed session_id=%s err=%v", deviceID, err)
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+	chunk := func(delta chatResponseMessage, finishReason *string) chatCompletion {
+		out := completion
+		out.Choices = []chatChoice{{Delta: &delta, FinishReason: finishReason}}
+		return out
+	}
+
+	if !writeChunk(chunk(chatResponseMessage{Role: "assistant"}, nil)) {
+		return
+	}
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case res := <-done:
+			if res.err != nil {
+				msgErr := asMessageError(res.err)
+				writeChunk(gin.H{"error": gin.H{"message": msgErr.Message, "type": openAIErrorType(msgErr.Status), "code": msgErr.Code}})
+				return
+			}
+			stop := "stop"
+			if writeChunk(chunk(chatResponseMessage{Content: chatReply(res.payload)}, nil)) && writeChunk(chunk(chatResponseMessage{}, &stop)) {
+				fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+				c.Writer.Flush()
+			}
+			return
+		}
+	}
+}
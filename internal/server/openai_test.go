@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clawproxy/internal/ratelimit"
+)
+
+func TestChatCompletions_MapsLastUserMessage(t *testing.T) {
+	exec := &fakeExecutor{output: `{"reply":"hi there","meta":{"ms":12}}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+
+	body := map[string]any{
+		"model": "gpt-4o",
+		"user":  "device-1",
+		"messages": []map[string]any{
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": "first"},
+			{"role": "assistant", "content": "ok"},
+			{"role": "user", "content": []map[string]string{{"type": "text", "text": "second"}}},
+		},
+	}
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/chat/completions", mustCreateToken(t), body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if exec.gotDeviceID != "device-1" || exec.gotMessages[0] != "second" {
+		t.Fatalf("unexpected executor call: device=%q messages=%v", exec.gotDeviceID, exec.gotMessages)
+	}
+
+	var resp chatCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode completion: %v", err)
+	}
+	if resp.Object != "chat.completion" || resp.Model != "gpt-4o" || len(resp.Choices) != 1 {
+		t.Fatalf("unexpected completion: %+v", resp)
+	}
+	if msg := resp.Choices[0].Message; msg == nil || msg.Role != "assistant" || msg.Content != "hi there" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestChatCompletions_SessionFromTokenSubject(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+
+	body := map[string]any{"messages": []map[string]any{{"role": "user", "content": "hello"}}}
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/chat/completions", mustCreateToken(t), body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if exec.gotDeviceID != "device-1" {
+		t.Fatalf("expected token subject as session id, got %q", exec.gotDeviceID)
+	}
+}
+
+func TestChatCompletions_Stream(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{"reply":"streamed"}`})
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/chat/completions", strings.NewReader(`{"stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+mustCreateToken(t))
+	req.Header.Set(chatSessionHeader, "device-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post chat completion: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	var sawDone bool
+	for _, ev := range readSSEData(t, resp) {
+		if ev == "[DONE]" {
+			sawDone = true
+			continue
+		}
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(ev), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", ev, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 || chunk.Choices[0].Delta == nil {
+			t.Fatalf("unexpected chunk: %s", ev)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if content.String() != "streamed" || !sawDone {
+		t.Fatalf("unexpected stream content=%q done=%t", content.String(), sawDone)
+	}
+}
+
+func readSSEData(t *testing.T, resp *http.Response) []string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read event stream: %v", err)
+	}
+
+	var data []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	return data
+}
+
+func TestChatCompletions_ErrorTypes(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{"reply":"hi"}`}, WithLimits(ratelimit.Limits{PerMinute: 1, Burst: 1}))
+	body := map[string]any{"messages": []map[string]any{{"role": "user", "content": "hello"}}}
+
+	doJSON(t, srv.Engine(), http.MethodPost, "/v1/chat/completions", mustCreateToken(t), body)
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/chat/completions", mustCreateToken(t), body)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), `"type":"rate_limit_error"`) {
+		t.Fatalf("expected a rate_limit_error with Retry-After, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	srv = NewWithExecutor(":0", testJWTSecret, &fakeExecutor{err: &messageError{Status: http.StatusBadRequest, Code: "INVALID_REQUEST", Message: "bad"}})
+	w = doJSON(t, srv.Engine(), http.MethodPost, "/v1/chat/completions", mustCreateToken(t), body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"type":"invalid_request_error"`) {
+		t.Fatalf("expected an invalid_request_error, got %d %s", w.Code, w.Body.String())
+	}
+}
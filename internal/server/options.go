@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"clawproxy/internal/auth"
+)
+
+// Option value types.
+const (
+	OptionString = "string"
+	OptionEnum   = "enum"
+	OptionInt    = "int"
+	OptionBool   = "bool"
+)
+
+// OptionRule allows clients to send one entry of a request's options object
+// and maps it to a command-line flag.
+type OptionRule struct {
+	Flag string `json:"flag"`
+	Type string `json:"type"`
+	// Values lists the accepted values of an enum option.
+	Values []string `json:"values,omitempty"`
+	// Min and Max bound an int option.
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+	// Pattern must match the whole value of a string option.
+	Pattern string `json:"pattern,omitempty"`
+	// Scopes, when set, restricts the option to tokens holding one of them.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (r OptionRule) Validate(name string) error {
+	if !strings.HasPrefix(r.Flag, "-") {
+		return fmt.Errorf("option %s: flag must start with '-'", name)
+	}
+	switch r.Type {
+	case OptionString:
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("option %s: invalid pattern: %w", name, err)
+		}
+	case OptionEnum:
+		if len(r.Values) == 0 {
+			return fmt.Errorf("option %s: enum needs values", name)
+		}
+	case OptionInt, OptionBool:
+	default:
+		return fmt.Errorf("option %s: unknown type %q, expected string, enum, int or bool", name, r.Type)
+	}
+	if err := auth.ValidateScopes(r.Scopes); err != nil {
+		return fmt.Errorf("option %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// WithOptions sets the options clients may send for tokens without a tenant.
+func WithOptions(rules map[string]OptionRule) Option {
+	return func(s *Server) {
+		s.options = rules
+	}
+}
+
+func (s *Server) optionRules(claims *auth.Claims) map[string]OptionRule {
+	if t, ok := s.tenants[claims.Tenant]; ok && claims.Tenant != "" && t.cfg.Options != nil {
+		return t.cfg.Options
+	}
+
+	return s.options
+}
+
+// optionArgs validates the request's options against the allowlist and
+// returns the flags to pass, ordered by option name.
+func (s *Server) optionArgs(claims *auth.Claims, options map[string]any) ([]string, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+
+	rules := s.optionRules(claims)
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		rule, ok := rules[name]
+		if !ok {
+			return nil, &messageError{Status: http.StatusBadRequest, Code: "INVALID_OPTION", Message: "unknown option: " + name}
+		}
+		if len(rule.Scopes) > 0 && !slices.ContainsFunc(rule.Scopes, claims.HasScope) {
+			return nil, &messageError{Status: http.StatusForbidden, Code: "OPTION_FORBIDDEN", Message: "option not allowed for this token: " + name}
+		}
+
+		value, err := rule.format(options[name])
+		if err != nil {
+			return nil, &messageError{Status: http.StatusBadRequest, Code: "INVALID_OPTION", Message: fmt.Sprintf("option %s: %v", name, err)}
+		}
+		switch {
+		case rule.Type != OptionBool:
+			args = append(args, rule.Flag, value)
+		case value == "true":
+			args = append(args, rule.Flag)
+		}
+	}
+
+	return args, nil
+}
+
+// format checks a JSON option value and renders it as a flag value.
+func (r OptionRule) format(v any) (string, error) {
+	switch r.Type {
+	case OptionBool:
+		b, ok := v.(bool)
+		if !ok {
+			return "", errors.New("expected true or false")
+		}
+		return strconv.FormatBool(b), nil
+	case OptionInt:
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return "", errors.New("expected an integer")
+		}
+		n := int(f)
+		if r.Min != nil && n < *r.Min {
+			return "", fmt.Errorf("must be at least %d", *r.Min)
+		}
+		if r.Max != nil && n > *r.Max {
+			return "", fmt.Errorf("must be at most %d", *r.Max)
+		}
+		return strconv.Itoa(n), nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.New("expected a string")
+	}
+	if r.Type == OptionEnum {
+		if !slices.Contains(r.Values, s) {
+			return "", fmt.Errorf("expected one of %s", strings.Join(r.Values, ", "))
+		}
+		return s, nil
+	}
+	// A value starting with '-' could be parsed as another flag.
+	if strings.HasPrefix(s, "-") {
+		return "", errors.New("must not start with '-'")
+	}
+	if r.Pattern != "" {
+		pattern, err := regexp.Compile(`^(?:` + r.Pattern + `)$`)
+		if err != nil {
+			return "", fmt.Errorf("invalid pattern: %w", err)
+		}
+		if !pattern.MatchString(s) {
+			return "", fmt.Errorf("must match %s", r.Pattern)
+		}
+	}
+
+	return s, nil
+}
+
+type optionArgsKey struct{}
+
+func withOptionArgs(ctx context.Context, args []string) context.Context {
+	return context.WithValue(ctx, optionArgsKey{}, args)
+}
+
+// optionArgsFrom returns the validated option flags of the running message.
+func optionArgsFrom(ctx context.Context) []string {
+	args, _ := ctx.Value(optionArgsKey{}).([]string)
+	return args
+}
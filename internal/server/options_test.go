@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clawproxy/internal/auth"
+)
+
+func intPtr(n int) *int {
+	return &n
+}
+
+var testOptionRules = map[string]OptionRule{
+	"model":    {Flag: "--model", Type: OptionString, Pattern: `[a-z0-9.-]+`},
+	"thinking": {Flag: "--thinking", Type: OptionEnum, Values: []string{"off", "low", "high"}},
+	"timeout":  {Flag: "--timeout", Type: OptionInt, Min: intPtr(1), Max: intPtr(600)},
+	"verbose":  {Flag: "--verbose", Type: OptionBool},
+	"agent":    {Flag: "--agent", Type: OptionString, Scopes: []string{auth.ScopeAdmin}},
+}
+
+func TestOptionArgs(t *testing.T) {
+	srv := New(":0", testJWTSecret, WithOptions(testOptionRules))
+	claims := &auth.Claims{Subject: "device-1"}
+
+	args, err := srv.optionArgs(claims, map[string]any{"verbose": true, "timeout": float64(30), "thinking": "high", "model": "gpt-5.1"})
+	if err != nil {
+		t.Fatalf("option args: %v", err)
+	}
+	if got := strings.Join(args, " "); got != "--model gpt-5.1 --thinking high --timeout 30 --verbose" {
+		t.Fatalf("unexpected args: %s", got)
+	}
+
+	tests := map[string]struct {
+		options map[string]any
+		code    string
+	}{
+		"unknown":       {map[string]any{"temperature": 0.2}, "INVALID_OPTION"},
+		"enum":          {map[string]any{"thinking": "max"}, "INVALID_OPTION"},
+		"range":         {map[string]any{"timeout": float64(601)}, "INVALID_OPTION"},
+		"fraction":      {map[string]any{"timeout": 1.5}, "INVALID_OPTION"},
+		"type":          {map[string]any{"verbose": "yes"}, "INVALID_OPTION"},
+		"flag value":    {map[string]any{"model": "--config=/etc/passwd"}, "INVALID_OPTION"},
+		"pattern":       {map[string]any{"model": "GPT 5"}, "INVALID_OPTION"},
+		"missing scope": {map[string]any{"agent": "ops"}, "OPTION_FORBIDDEN"},
+	}
+	for name, tt := range tests {
+		if _, err := srv.optionArgs(claims, tt.options); err == nil || asMessageError(err).Code != tt.code {
+			t.Fatalf("%s: expected %s, got %v", name, tt.code, err)
+		}
+	}
+
+	admin := &auth.Claims{Subject: "ops", Scope: auth.ScopeAdmin}
+	if _, err := srv.optionArgs(admin, map[string]any{"agent": "ops"}); err != nil {
+		t.Fatalf("expected admin to use scoped option: %v", err)
+	}
+}
+
+type optionRecordingExecutor struct {
+	args []string
+}
+
+func (e *optionRecordingExecutor) Run(ctx context.Context, _, _ string) (string, error) {
+	e.args = optionArgsFrom(ctx)
+	return `{"result":"ok"}`, nil
+}
+
+func TestDeviceMessage_ForwardsOptions(t *testing.T) {
+	exec := &optionRecordingExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec, WithOptions(testOptionRules))
+
+	body := map[string]any{"message": "hi", "options": map[string]any{"thinking": "low"}}
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := strings.Join(exec.args, " "); got != "--thinking low" {
+		t.Fatalf("unexpected option args: %q", got)
+	}
+}
+
+func TestHandleWS_RejectsUnknownOption(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateToken(t))
+	defer conn.Close()
+
+	if err := conn.WriteJSON(wsRequest{Message: "hi", Options: map[string]any{"model": "x"}}); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	var resp wsError
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read error frame: %v", err)
+	}
+	if resp.Code != "INVALID_OPTION" || !strings.Contains(resp.Error, "model") || resp.ResetAt != 0 {
+		t.Fatalf("unexpected error frame: %+v", resp)
+	}
+	if len(exec.gotMessages) != 0 {
+		t.Fatal("expected executor not to run")
+	}
+}
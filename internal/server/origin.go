@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type originPattern struct {
+	scheme string
+	host   string
+	// port is empty for the default port of the origin's scheme.
+	port string
+	// wildcard matches any subdomain of host, but not host itself.
+	wildcard bool
+}
+
+// OriginAllowlist decides which browser origins may open a WebSocket.
+// Requests without an Origin header come from native clients and are always allowed.
+type OriginAllowlist struct {
+	allowAny bool
+	patterns []originPattern
+}
+
+// NewOriginAllowlist parses patterns such as "https://app.example.com",
+// "https://*.example.com" or "*.example.com" (any scheme). As in browsers the
+// port is part of the origin: a pattern without one matches only the default
+// port of the scheme, so "https://app.example.com:8443" must be listed as
+// such. With no patterns only same-origin browser requests are accepted.
+func NewOriginAllowlist(patterns []string, allowAny bool) (*OriginAllowlist, error) {
+	list := &OriginAllowlist{allowAny: allowAny}
+	for _, raw := range patterns {
+		raw = strings.ToLower(strings.TrimSpace(raw))
+		if raw == "" {
+			continue
+		}
+
+		var p originPattern
+		host := raw
+		if scheme, rest, ok := strings.Cut(raw, "://"); ok {
+			p.scheme = scheme
+			host = rest
+		}
+		if strings.HasPrefix(host, "*.") {
+			p.wildcard = true
+			host = strings.TrimPrefix(host, "*")
+		}
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid origin pattern: %q", raw)
+			}
+			host, p.port = h, port
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" || host == "." || strings.ContainsAny(host, "/*") {
+			return nil, fmt.Errorf("invalid origin pattern: %q", raw)
+		}
+		p.host = host
+		list.patterns = append(list.patterns, p)
+	}
+
+	return list, nil
+}
+
+func (l *OriginAllowlist) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || l.allowAny {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := originPort(scheme, u.Port())
+
+	// A Host without a port is taken to be on the origin's default port, so
+	// TLS terminated in front of the proxy still counts as the same origin.
+	reqHost, reqPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		reqHost, reqPort = r.Host, ""
+	}
+	reqHost = strings.TrimSuffix(strings.TrimPrefix(reqHost, "["), "]")
+	if strings.EqualFold(host, reqHost) && originPort(scheme, reqPort) == port {
+		return true
+	}
+
+	for _, p := range l.patterns {
+		if p.scheme != "" && p.scheme != scheme {
+			continue
+		}
+		if originPort(scheme, p.port) != port {
+			continue
+		}
+		if p.wildcard && strings.HasSuffix(host, p.host) {
+			return true
+		}
+		if !p.wildcard && host == p.host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originPort returns port, or the default port of scheme when it is empty.
+func originPort(scheme, port string) string {
+	if port != "" {
+		return port
+	}
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	case "http", "ws":
+		return "80"
+	}
+
+	return ""
+}
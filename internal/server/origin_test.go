@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowlist(t *testing.T) {
+	list, err := NewOriginAllowlist([]string{"https://app.example.com", "https://*.example.org", "*.example.net", "https://dev.example.com:8443"}, false)
+	if err != nil {
+		t.Fatalf("parse allowlist: %v", err)
+	}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://proxy.local", true},
+		{"https://app.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://badexample.org", false},
+		{"http://x.example.net", true},
+		{"https://app.example.com:443", true},
+		{"https://app.example.com:8443", false},
+		{"https://dev.example.com:8443", true},
+		{"https://dev.example.com", false},
+		{"null", false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy.local/ws", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if got := list.Allowed(req); got != tc.want {
+			t.Fatalf("origin %q: expected %v, got %v", tc.origin, tc.want, got)
+		}
+	}
+}
+
+func TestOriginAllowlist_SameOriginPort(t *testing.T) {
+	list, err := NewOriginAllowlist(nil, false)
+	if err != nil {
+		t.Fatalf("parse allowlist: %v", err)
+	}
+
+	cases := []struct {
+		host   string
+		origin string
+		want   bool
+	}{
+		{"proxy.local:8080", "http://proxy.local:8080", true},
+		{"proxy.local:8080", "http://proxy.local", false},
+		{"proxy.local", "https://proxy.local", true},
+		{"proxy.local:443", "https://proxy.local", true},
+		{"proxy.local", "http://proxy.local:9090", false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy.local/ws", nil)
+		req.Host = tc.host
+		req.Header.Set("Origin", tc.origin)
+		if got := list.Allowed(req); got != tc.want {
+			t.Fatalf("host %q origin %q: expected %v, got %v", tc.host, tc.origin, tc.want, got)
+		}
+	}
+}
+
+func TestOriginAllowlist_AllowAny(t *testing.T) {
+	list, err := NewOriginAllowlist(nil, true)
+	if err != nil {
+		t.Fatalf("parse allowlist: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.local/ws", nil)
+	req.Header.Set("Origin", "https://anything.test")
+	if !list.Allowed(req) {
+		t.Fatal("expected any origin to be allowed")
+	}
+}
+
+func TestNewOriginAllowlist_Invalid(t *testing.T) {
+	for _, pattern := range []string{"https://*", "https://app.example.com:https"} {
+		if _, err := NewOriginAllowlist([]string{pattern}, false); err == nil {
+			t.Fatalf("expected invalid pattern error for %q", pattern)
+		}
+	}
+}
+
+func TestHandleWS_OriginRejected(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	r := srv.Engine()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?deviceId=device-1", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Authorization", mustCreateToken(t))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "ORIGIN_NOT_ALLOWED") {
+		t.Fatalf("unexpected response body: %s", w.Body.String())
+	}
+	if got := srv.metrics.Value("clawproxy_ws_origin_rejected_total"); got != 1 {
+		t.Fatalf("expected origin rejection metric 1, got %v", got)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+	"clawproxy/internal/pairing"
+	"github.com/gin-gonic/gin"
+)
+
+var errTokenRevoked = errors.New("jwt token revoked")
+
+type createPairingRequest struct {
+	DeviceID              string   `json:"deviceId"`
+	Scopes                []string `json:"scopes"`
+	TTLSeconds            int64    `json:"ttlSeconds"`
+	TokenExpiresInSeconds int64    `json:"tokenExpiresInSeconds"`
+}
+
+type pairingResponse struct {
+	pairing.Pairing
+	Status string `json:"status"`
+}
+
+type exchangePairingRequest struct {
+	Code string `json:"code"`
+}
+
+const defaultPairingTTL = 10 * time.Minute
+
+func newPairingResponse(p pairing.Pairing) pairingResponse {
+	return pairingResponse{Pairing: p, Status: p.Status(time.Now())}
+}
+
+func (s *Server) handleCreatePairing(c *gin.Context) {
+	var req createPairingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": "invalid json payload"})
+		return
+	}
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": err.Error()})
+		return
+	}
+	if err := auth.ValidateDeviceID("", req.DeviceID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": err.Error()})
+		return
+	}
+
+	ttl := defaultPairingTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	p, err := s.pairings.Create(pairing.CreateRequest{
+		DeviceID:       req.DeviceID,
+		Scopes:         req.Scopes,
+		TTL:            ttl,
+		TokenExpiresIn: time.Duration(req.TokenExpiresInSeconds) * time.Second,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": err.Error()})
+		return
+	}
+
+	log.Printf("[server] pairing created id=%s session_id=%s by=%s", p.ID, p.DeviceID, requestClaims(c).Subject)
+	c.JSON(http.StatusCreated, newPairingResponse(*p))
+}
+
+func (s *Server) handleListPairings(c *gin.Context) {
+	list := s.pairings.List()
+	resp := make([]pairingResponse, 0, len(list))
+	for _, p := range list {
+		resp = append(resp, newPairingResponse(p))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pairings": resp})
+}
+
+func (s *Server) handleRevokePairing(c *gin.Context) {
+	p, err := s.pairings.Revoke(c.Param("id"))
+	if errors.Is(err, pairing.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"code": "NOT_FOUND", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("[server] revoke pairing failed id=%s err=%v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": "INTERNAL_ERROR", "error": "revoke pairing failed"})
+		return
+	}
+
+	log.Printf("[server] pairing revoked id=%s session_id=%s by=%s", p.ID, p.DeviceID, requestClaims(c).Subject)
+	c.JSON(http.StatusOK, newPairingResponse(*p))
+}
+
+// handleExchangePairing trades a one-time pairing code for the device's token.
+// The code itself is the credential, so the route is unauthenticated.
+func (s *Server) handleExchangePairing(c *gin.Context) {
+	var req exchangePairingRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": "code is required"})
+		return
+	}
+
+	lockKeys := lockoutKeys(c.ClientIP(), "")
+	if s.rejectLockedOut(c, lockKeys...) {
+		log.Printf("[server] pairing exchange rejected: locked out client_ip=%s", c.ClientIP())
+		return
+	}
+
+	p, err := s.pairings.Consume(strings.TrimSpace(req.Code))
+	if err != nil {
+		log.Printf("[server] pairing exchange rejected client_ip=%s err=%v", c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, gin.H{"code": "INVALID_PAIRING_CODE", "error": err.Error()})
+		s.recordAuthResult(c, false, lockKeys...)
+		return
+	}
+	s.recordAuthResult(c, true, lockKeys...)
+
+	claims := auth.Claims{ID: p.ID, Subject: p.DeviceID, Scope: strings.Join(p.Scopes, " ")}
+	if p.TokenExpiresIn > 0 {
+		expiresAt := time.Now().Unix() + p.TokenExpiresIn
+		claims.ExpiresAt = &expiresAt
+	}
+	token, err := auth.SignToken(s.jwtSecret, claims)
+	if err != nil {
+		log.Printf("[server] sign paired token failed id=%s err=%v", p.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": "INTERNAL_ERROR", "error": "issue token failed"})
+		return
+	}
+
+	log.Printf("[server] pairing exchanged id=%s session_id=%s client_ip=%s", p.ID, p.DeviceID, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"deviceId": p.DeviceID, "token": token, "expiresAt": claims.ExpiresAt})
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+func doJSON(t *testing.T, h http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w
+}
+
+func mustCreateAdminToken(t *testing.T) string {
+	t.Helper()
+	token, err := auth.GenerateToken([]byte(testJWTSecret), "ops", time.Hour, auth.ScopeAdmin)
+	if err != nil {
+		t.Fatalf("sign admin token: %v", err)
+	}
+
+	return token
+}
+
+func TestPairing_CreateExchangeRevoke(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	r := srv.Engine()
+	admin := mustCreateAdminToken(t)
+
+	w := doJSON(t, r, http.MethodPost, "/v1/admin/pairings", admin, map[string]any{"deviceId": "device-9", "scopes": []string{"chat"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created pairingResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode pairing: %v", err)
+	}
+	if created.Status != "pending" {
+		t.Fatalf("expected pending pairing, got %q", created.Status)
+	}
+
+	w = doJSON(t, r, http.MethodPost, "/v1/pair", "", map[string]string{"code": created.Code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var exchanged struct {
+		DeviceID string `json:"deviceId"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &exchanged); err != nil {
+		t.Fatalf("decode exchange response: %v", err)
+	}
+	if exchanged.DeviceID != "device-9" {
+		t.Fatalf("unexpected device id: %q", exchanged.DeviceID)
+	}
+	if _, err := srv.validateToken(exchanged.Token); err != nil {
+		t.Fatalf("validate paired token: %v", err)
+	}
+
+	w = doJSON(t, r, http.MethodPost, "/v1/pair", "", map[string]string{"code": created.Code})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected reused code status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w = doJSON(t, r, http.MethodDelete, "/v1/admin/pairings/"+created.ID, admin, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if _, err := srv.validateToken(exchanged.Token); err == nil {
+		t.Fatal("expected token from revoked pairing to be rejected")
+	}
+}
+
+func TestPairing_AdminRoutesRequireAdminScope(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+	w := doJSON(t, srv.Engine(), http.MethodGet, "/v1/admin/pairings", mustCreateToken(t), nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func clientIPEngine(t *testing.T, srv *Server) *gin.Engine {
+	t.Helper()
+	r := srv.Engine()
+	r.GET("/test-client-ip", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+
+	return r
+}
+
+func TestEngine_IgnoresForwardedForByDefault(t *testing.T) {
+	r := clientIPEngine(t, New(":0", testJWTSecret))
+
+	req := httptest.NewRequest(http.MethodGet, "/test-client-ip", nil)
+	req.RemoteAddr = "198.51.100.20:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Body.String() != "198.51.100.20" {
+		t.Fatalf("expected peer address, got %q", w.Body.String())
+	}
+}
+
+func TestEngine_TrustedProxyForwardedFor(t *testing.T) {
+	proxies, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parse proxies: %v", err)
+	}
+	r := clientIPEngine(t, New(":0", testJWTSecret, WithTrustedProxies(proxies)))
+
+	req := httptest.NewRequest(http.MethodGet, "/test-client-ip", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Body.String() != "203.0.113.9" {
+		t.Fatalf("expected forwarded address, got %q", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/test-client-ip", nil)
+	req.RemoteAddr = "198.51.100.20:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Body.String() != "198.51.100.20" {
+		t.Fatalf("expected untrusted peer address, got %q", w.Body.String())
+	}
+}
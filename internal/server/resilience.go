@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Circuit states.
+const (
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half-open"
+	CircuitOpen     = "open"
+)
+
+const (
+	defaultRetryBaseDelay  = 200 * time.Millisecond
+	defaultRetryMaxDelay   = 5 * time.Second
+	defaultCircuitFailures = 5
+	defaultCircuitCooldown = 30 * time.Second
+)
+
+// wrapper is implemented by executors decorating others, so the server can
+// find the circuit breakers in a chain.
+type wrapper interface {
+	wrapped() []CommandExecutor
+}
+
+// runExecutor streams through e when it can and output is wanted.
+func runExecutor(ctx context.Context, e CommandExecutor, deviceID, message string, onOutput func([]byte)) (string, error) {
+	if streaming, ok := e.(StreamingExecutor); ok && onOutput != nil {
+		return streaming.RunStream(ctx, deviceID, message, onOutput)
+	}
+
+	return e.Run(ctx, deviceID, message)
+}
+
+// trackOutput wraps onOutput to report whether any output went through it.
+func trackOutput(onOutput func([]byte)) (func([]byte), func() bool) {
+	if onOutput == nil {
+		return nil, func() bool { return false }
+	}
+	var sent atomic.Bool
+	return func(p []byte) {
+		if len(p) > 0 {
+			sent.Store(true)
+		}
+		onOutput(p)
+	}, sent.Load
+}
+
+// executorBroken reports whether err says the executor is failing, as opposed
+// to the caller going away or the request being refused.
+func executorBroken(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var msgErr *messageError
+	return !errors.As(err, &msgErr) || msgErr.Status >= http.StatusInternalServerError
+}
+
+// RetryConfig retries failed runs with exponential backoff.
+type RetryConfig struct {
+	// Attempts counts the first run too; values below two never retry.
+	Attempts int `json:"attempts"`
+	// ExitCodes are the command exit codes worth retrying.
+	ExitCodes []int `json:"exitCodes,omitempty"`
+	// ErrorCodes are proxy error codes worth retrying, e.g. UPSTREAM_UNAVAILABLE.
+	ErrorCodes  []string `json:"errorCodes,omitempty"`
+	BaseDelayMs int      `json:"baseDelayMs,omitempty"`
+	MaxDelayMs  int      `json:"maxDelayMs,omitempty"`
+}
+
+func (c RetryConfig) Validate() error {
+	if c.Attempts < 0 || c.BaseDelayMs < 0 || c.MaxDelayMs < 0 {
+		return fmt.Errorf("retry: values must not be negative")
+	}
+	if c.Attempts > 1 && len(c.ExitCodes) == 0 && len(c.ErrorCodes) == 0 {
+		return fmt.Errorf("retry: exitCodes or errorCodes is required")
+	}
+
+	return nil
+}
+
+func (c RetryConfig) retryable(err error) bool {
+	// Matches *exec.ExitError and recorded exits replayed from a cassette.
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && slices.Contains(c.ExitCodes, exitErr.ExitCode()) {
+		return true
+	}
+	var msgErr *messageError
+	return errors.As(err, &msgErr) && slices.Contains(c.ErrorCodes, msgErr.Code)
+}
+
+func (c RetryConfig) delay(retry int) time.Duration {
+	base, max := defaultRetryBaseDelay, defaultRetryMaxDelay
+	if c.BaseDelayMs > 0 {
+		base = time.Duration(c.BaseDelayMs) * time.Millisecond
+	}
+	if c.MaxDelayMs > 0 {
+		max = time.Duration(c.MaxDelayMs) * time.Millisecond
+	}
+	delay := time.Duration(float64(base) * math.Pow(2, float64(retry-1)))
+	if delay > max || delay <= 0 {
+		return max
+	}
+
+	return delay
+}
+
+// RetryExecutor reruns Next while it fails with a retryable error. An attempt
+// that already streamed output to the client is not retried, so the client
+// never sees the output of two attempts.
+type RetryExecutor struct {
+	Next   CommandExecutor
+	Config RetryConfig
+}
+
+func (e RetryExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e RetryExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	onOutput, streamed := trackOutput(onOutput)
+	for attempt := 1; ; attempt++ {
+		output, err := runExecutor(ctx, e.Next, deviceID, message, onOutput)
+		if err == nil || attempt >= e.Config.Attempts || !e.Config.retryable(err) || ctx.Err() != nil {
+			return output, err
+		}
+		if streamed() {
+			log.Printf("[executor] not retrying, output already streamed session_id=%s err=%v", deviceID, err)
+			return output, err
+		}
+
+		delay := e.Config.delay(attempt)
+		log.Printf("[executor] retrying session_id=%s attempt=%d delay=%s err=%v", deviceID, attempt+1, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return output, err
+		}
+	}
+}
+
+func (e RetryExecutor) wrapped() []CommandExecutor {
+	return []CommandExecutor{e.Next}
+}
+
+// CircuitConfig opens a circuit after consecutive failures.
+type CircuitConfig struct {
+	Failures int `json:"failures,omitempty"`
+	// CooldownSeconds is how long the circuit stays open before one trial
+	// run may close it again.
+	CooldownSeconds int `json:"cooldownSeconds,omitempty"`
+}
+
+func (c CircuitConfig) Validate() error {
+	if c.Failures < 0 || c.CooldownSeconds < 0 {
+		return fmt.Errorf("circuit: values must not be negative")
+	}
+
+	return nil
+}
+
+// CircuitBreaker fast-fails with UPSTREAM_UNAVAILABLE while Next keeps
+// failing, instead of letting every request fail slowly.
+type CircuitBreaker struct {
+	Name string
+
+	next     CommandExecutor
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	openedAt    time.Time
+	trial       bool
+	// generation changes with the state, so runs admitted under an earlier
+	// state cannot move the current one.
+	generation uint64
+}
+
+// circuitTicket is handed to each admitted run and given back with its outcome.
+type circuitTicket struct {
+	generation uint64
+	trial      bool
+}
+
+func NewCircuitBreaker(name string, next CommandExecutor, cfg CircuitConfig) *CircuitBreaker {
+	b := &CircuitBreaker{Name: name, next: next, failures: defaultCircuitFailures, cooldown: defaultCircuitCooldown, now: time.Now, state: CircuitClosed}
+	if cfg.Failures > 0 {
+		b.failures = cfg.Failures
+	}
+	if cfg.CooldownSeconds > 0 {
+		b.cooldown = time.Duration(cfg.CooldownSeconds) * time.Second
+	}
+
+	return b
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+
+	return b.state
+}
+
+func (b *CircuitBreaker) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return b.RunStream(ctx, deviceID, message, nil)
+}
+
+func (b *CircuitBreaker) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	ticket, err := b.allow()
+	if err != nil {
+		log.Printf("[executor] circuit open, failing fast session_id=%s circuit=%s", deviceID, b.Name)
+		return "", err
+	}
+
+	output, err := runExecutor(ctx, b.next, deviceID, message, onOutput)
+	b.record(ctx, ticket, err)
+	return output, err
+}
+
+func (b *CircuitBreaker) allow() (circuitTicket, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.state == CircuitOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.setState(CircuitHalfOpen)
+	}
+	switch {
+	case b.state == CircuitClosed:
+		return circuitTicket{generation: b.generation}, nil
+	case b.state == CircuitHalfOpen && !b.trial:
+		b.trial = true
+		return circuitTicket{generation: b.generation, trial: true}, nil
+	}
+
+	resetAt := b.openedAt.Add(b.cooldown)
+	if !resetAt.After(now) {
+		resetAt = now.Add(time.Second)
+	}
+	return circuitTicket{}, &messageError{Status: http.StatusServiceUnavailable, Code: "UPSTREAM_UNAVAILABLE", Message: "agent is unavailable, try again later", ResetAt: resetAt}
+}
+
+// record counts the run's outcome. Runs whose caller went away say nothing
+// about the executor, since their command was killed, and neither do refused
+// requests or runs past a timeout the client shortened; all leave the state
+// alone, as do runs admitted before the state last changed.
+func (b *CircuitBreaker) record(ctx context.Context, ticket circuitTicket, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.trial {
+		b.trial = false
+	}
+	if ticket.generation != b.generation || errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && shortenedTimeout(ctx) {
+		return
+	}
+	switch {
+	case executorBroken(err):
+		b.consecutive++
+		if ticket.trial || b.consecutive >= b.failures {
+			log.Printf("[executor] circuit opened circuit=%s failures=%d err=%v", b.Name, b.consecutive, err)
+			b.setState(CircuitOpen)
+			b.openedAt = b.now()
+		}
+	case err == nil:
+		if b.state != CircuitClosed {
+			log.Printf("[executor] circuit closed circuit=%s", b.Name)
+			b.setState(CircuitClosed)
+		}
+		b.consecutive = 0
+	}
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	b.state = state
+	b.consecutive = 0
+	b.generation++
+}
+
+func (b *CircuitBreaker) wrapped() []CommandExecutor {
+	return []CommandExecutor{b.next}
+}
+
+// FallbackExecutor runs Fallback when Primary is broken: failing, timing out
+// on its own or behind an open circuit. A Primary that already streamed
+// output to the client is not replaced.
+type FallbackExecutor struct {
+	Primary  CommandExecutor
+	Fallback CommandExecutor
+}
+
+func (e FallbackExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e FallbackExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	tracked, streamed := trackOutput(onOutput)
+	output, err := runExecutor(ctx, e.Primary, deviceID, message, tracked)
+	if !executorBroken(err) || ctx.Err() != nil {
+		return output, err
+	}
+	if streamed() {
+		log.Printf("[executor] not falling back, output already streamed session_id=%s err=%v", deviceID, err)
+		return output, err
+	}
+
+	log.Printf("[executor] primary failed, using fallback session_id=%s err=%v", deviceID, err)
+	return runExecutor(ctx, e.Fallback, deviceID, message, onOutput)
+}
+
+func (e FallbackExecutor) wrapped() []CommandExecutor {
+	return []CommandExecutor{e.Primary, e.Fallback}
+}
+
+// walkExecutors calls visit with every executor in the server's chains,
+// wrapped ones included.
+func (s *Server) walkExecutors(visit func(CommandExecutor)) {
+	var walk func(e CommandExecutor)
+	walk = func(e CommandExecutor) {
+		visit(e)
+		if w, ok := e.(wrapper); ok {
+			for _, inner := range w.wrapped() {
+				walk(inner)
+			}
+		}
+	}
+	walk(s.executor)
+	for _, t := range s.tenants {
+		walk(t.executor)
+	}
+}
+
+// circuitBreakers finds every breaker in the server's executor chains.
+func (s *Server) circuitBreakers() []*CircuitBreaker {
+	var breakers []*CircuitBreaker
+	seen := make(map[*CircuitBreaker]bool)
+	s.walkExecutors(func(e CommandExecutor) {
+		if b, ok := e.(*CircuitBreaker); ok && !seen[b] {
+			seen[b] = true
+			breakers = append(breakers, b)
+		}
+	})
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].Name < breakers[j].Name })
+
+	return breakers
+}
+
+// circuitStateValues are the clawproxy_circuit_state gauge values.
+var circuitStateValues = map[string]float64{CircuitClosed: 0, CircuitHalfOpen: 1, CircuitOpen: 2}
+
+func (s *Server) updateCircuitMetrics() {
+	for _, b := range s.circuitBreakers() {
+		s.metrics.Set("clawproxy_circuit_state", circuitStateValues[b.State()], "circuit", b.Name)
+	}
+}
+
+// checkCircuits fails readiness while any circuit is open.
+func (s *Server) checkCircuits() error {
+	var open []string
+	for _, b := range s.circuitBreakers() {
+		if b.State() == CircuitOpen {
+			open = append(open, b.Name)
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("circuit open: %s", strings.Join(open, ", "))
+	}
+
+	return nil
+}
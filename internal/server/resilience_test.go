@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedExecutor returns its results in order, repeating the last one.
+type scriptedExecutor struct {
+	mu      sync.Mutex
+	results []error
+	calls   int
+}
+
+func (e *scriptedExecutor) Run(_ context.Context, _, _ string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.results[min(e.calls, len(e.results)-1)]
+	e.calls++
+	if err != nil {
+		return "", err
+	}
+	return `{"ok":true}`, nil
+}
+
+// streamThenFailExecutor streams some output, then fails.
+type streamThenFailExecutor struct {
+	calls atomic.Int32
+}
+
+func (e *streamThenFailExecutor) Run(_ context.Context, _, _ string) (string, error) {
+	e.calls.Add(1)
+	return "", errUnavailable
+}
+
+func (e *streamThenFailExecutor) RunStream(_ context.Context, _, _ string, onOutput func([]byte)) (string, error) {
+	e.calls.Add(1)
+	onOutput([]byte("partial"))
+	return "partial", errUnavailable
+}
+
+var errUnavailable = &messageError{Status: http.StatusServiceUnavailable, Code: "UPSTREAM_UNAVAILABLE", Message: "agent upstream is unavailable"}
+
+func TestRetryExecutor_ExitCodes(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "attempts")
+	script := `n=$(cat "$1" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$1"; [ $n -ge 3 ] && printf '{"attempt":%d}' $n || exit $2`
+	retry := func(exitCode string) RetryExecutor {
+		return RetryExecutor{
+			Next:   TemplateExecutor{Binary: "sh", Args: []string{"-c", script, "sh", counter, exitCode}},
+			Config: RetryConfig{Attempts: 3, ExitCodes: []int{75}, BaseDelayMs: 1},
+		}
+	}
+
+	out, err := retry("75").Run(context.Background(), "dev-1", "hello")
+	if err != nil || out != `{"attempt":3}` {
+		t.Fatalf("expected the third attempt to succeed, got %q %v", out, err)
+	}
+
+	if err := os.Remove(counter); err != nil {
+		t.Fatalf("reset counter: %v", err)
+	}
+	if _, err := retry("1").Run(context.Background(), "dev-1", "hello"); err == nil {
+		t.Fatal("expected a non-retryable exit code to fail at once")
+	}
+}
+
+func TestRetryExecutor_ErrorCodes(t *testing.T) {
+	next := &scriptedExecutor{results: []error{errUnavailable, errUnavailable, nil}}
+	e := RetryExecutor{Next: next, Config: RetryConfig{Attempts: 2, ErrorCodes: []string{"UPSTREAM_UNAVAILABLE"}, BaseDelayMs: 1}}
+
+	if _, err := e.Run(context.Background(), "dev-1", "hello"); err == nil || next.calls != 2 {
+		t.Fatalf("expected two attempts then the error, got %d calls err=%v", next.calls, err)
+	}
+}
+
+func TestRetryAndFallback_KeepStreamedAttempt(t *testing.T) {
+	next := &streamThenFailExecutor{}
+	fallback := &fakeExecutor{output: `{"from":"fallback"}`}
+	e := FallbackExecutor{Primary: RetryExecutor{Next: next, Config: RetryConfig{Attempts: 3, ErrorCodes: []string{"UPSTREAM_UNAVAILABLE"}, BaseDelayMs: 1}}, Fallback: fallback}
+
+	var streamed strings.Builder
+	if _, err := e.RunStream(context.Background(), "dev-1", "hello", func(p []byte) { streamed.Write(p) }); err == nil {
+		t.Fatal("expected the streamed attempt's error")
+	}
+	if next.calls.Load() != 1 || len(fallback.gotMessages) != 0 || streamed.String() != "partial" {
+		t.Fatalf("expected only the first attempt's output, got %d calls, %d fallbacks, %q", next.calls.Load(), len(fallback.gotMessages), streamed.String())
+	}
+
+	if out, err := e.Run(context.Background(), "dev-1", "hello"); err != nil || out != `{"from":"fallback"}` || next.calls.Load() != 4 {
+		t.Fatalf("expected unstreamed runs to retry then fall back, got %q %v after %d calls", out, err, next.calls.Load())
+	}
+}
+
+func TestCircuitBreaker_OpensAndRecovers(t *testing.T) {
+	next := &scriptedExecutor{results: []error{errors.New("exit status 1"), errors.New("exit status 1"), nil}}
+	b := NewCircuitBreaker("primary", next, CircuitConfig{Failures: 2, CooldownSeconds: 30})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.Run(context.Background(), "dev-1", "hello")
+	b.Run(context.Background(), "dev-1", "hello")
+	if b.State() != CircuitOpen {
+		t.Fatalf("expected open circuit after two failures, got %s", b.State())
+	}
+
+	_, err := b.Run(context.Background(), "dev-1", "hello")
+	if msgErr := asMessageError(err); msgErr.Code != "UPSTREAM_UNAVAILABLE" || msgErr.ResetAt.IsZero() || next.calls != 2 {
+		t.Fatalf("expected a fast UPSTREAM_UNAVAILABLE, got %v after %d calls", err, next.calls)
+	}
+
+	now = now.Add(31 * time.Second)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("expected half-open circuit after cooldown, got %s", b.State())
+	}
+	if _, err := b.Run(context.Background(), "dev-1", "hello"); err != nil {
+		t.Fatalf("expected the trial run to succeed, got %v", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected closed circuit after a successful trial, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_IgnoresCallerErrors(t *testing.T) {
+	next := &scriptedExecutor{results: []error{context.Canceled, &messageError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED"}}}
+	b := NewCircuitBreaker("primary", next, CircuitConfig{Failures: 1})
+
+	b.Run(context.Background(), "dev-1", "hello")
+	b.Run(context.Background(), "dev-1", "hello")
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected canceled and refused runs to keep the circuit closed, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_IgnoresKilledCommandOfCanceledCaller(t *testing.T) {
+	b := NewCircuitBreaker("primary", TemplateExecutor{Binary: "sh", Args: []string{"-c", "sleep 30"}}, CircuitConfig{Failures: 1})
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(withKillGrace(context.Background(), 100*time.Millisecond))
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if _, err := b.Run(ctx, "dev-1", "hello"); err == nil {
+			t.Fatal("expected the canceled command to fail")
+		}
+		cancel()
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected closed websockets to keep the circuit closed, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_RefusedTrialKeepsHalfOpen(t *testing.T) {
+	next := &scriptedExecutor{results: []error{errors.New("exit status 1"), &messageError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED"}, nil}}
+	b := NewCircuitBreaker("primary", next, CircuitConfig{Failures: 1, CooldownSeconds: 30})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.Run(context.Background(), "dev-1", "hello")
+	now = now.Add(31 * time.Second)
+	b.Run(context.Background(), "dev-1", "hello")
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("expected a refused trial to leave the circuit half-open, got %s", b.State())
+	}
+	if _, err := b.Run(context.Background(), "dev-1", "hello"); err != nil {
+		t.Fatalf("expected another trial to run, got %v", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected closed circuit after a successful trial, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_IgnoresStaleRuns(t *testing.T) {
+	next := &scriptedExecutor{results: []error{errors.New("exit status 1"), nil}}
+	b := NewCircuitBreaker("primary", next, CircuitConfig{Failures: 1, CooldownSeconds: 30})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	stale, _ := b.allow()
+	b.Run(context.Background(), "dev-1", "hello")
+	now = now.Add(31 * time.Second)
+	trial, err := b.allow()
+	if err != nil || !trial.trial {
+		t.Fatalf("expected a trial after cooldown, got %#v %v", trial, err)
+	}
+	b.record(context.Background(), stale, nil)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("expected a run admitted before the circuit opened to leave it half-open, got %s", b.State())
+	}
+	if _, err := b.allow(); err == nil {
+		t.Fatal("expected the stale run to leave the trial running")
+	}
+	b.record(context.Background(), trial, nil)
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected the trial to close the circuit, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_IgnoresTimeoutsShortenedByClient(t *testing.T) {
+	breaker := NewCircuitBreaker("primary", TemplateExecutor{Binary: "sh", Args: []string{"-c", "sleep 30"}}, CircuitConfig{Failures: 1})
+	srv := NewWithExecutor(":0", testJWTSecret, breaker, WithTimeouts(TimeoutConfig{GraceSeconds: 1, Devices: map[string]int{"device-1": 2}}))
+	r := srv.Engine()
+
+	w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", TimeoutSeconds: 1})
+	if decodeErrorCode(t, w.Body.Bytes()) != "TIMEOUT" {
+		t.Fatalf("expected a timeout, got %d %s", w.Code, w.Body.String())
+	}
+	if breaker.State() != CircuitClosed {
+		t.Fatalf("expected a client's short timeout to keep the circuit closed, got %s", breaker.State())
+	}
+
+	w = doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi"})
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("expected the configured timeout to open the circuit, got %s after %d %s", breaker.State(), w.Code, w.Body.String())
+	}
+}
+
+func TestFallbackExecutor(t *testing.T) {
+	primary := NewCircuitBreaker("primary", &scriptedExecutor{results: []error{errors.New("exit status 1")}}, CircuitConfig{Failures: 1})
+	fallback := &fakeExecutor{output: `{"from":"fallback"}`}
+	e := FallbackExecutor{Primary: primary, Fallback: fallback}
+
+	for i := 0; i < 2; i++ {
+		out, err := e.Run(context.Background(), "dev-1", "hello")
+		if err != nil || out != `{"from":"fallback"}` {
+			t.Fatalf("run %d: expected the fallback's reply, got %q %v", i, out, err)
+		}
+	}
+	if len(fallback.gotMessages) != 2 {
+		t.Fatalf("expected the fallback to serve both runs, got %d", len(fallback.gotMessages))
+	}
+}
+
+func TestServer_CircuitStateInReadyzAndMetrics(t *testing.T) {
+	breaker := NewCircuitBreaker("primary", &scriptedExecutor{results: []error{errors.New("exit status 1")}}, CircuitConfig{Failures: 1})
+	srv := NewWithExecutor(":0", testJWTSecret, FallbackExecutor{Primary: RetryExecutor{Next: breaker}, Fallback: &fakeExecutor{output: `{}`}})
+	r := srv.Engine()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected ready with a closed circuit, got %d %s", w.Code, w.Body.String())
+	}
+
+	doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi"})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "circuit open: primary") {
+		t.Fatalf("expected not ready with an open circuit, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = doJSON(t, r, http.MethodGet, "/metrics", mustCreateAdminToken(t), nil)
+	if !strings.Contains(w.Body.String(), `clawproxy_circuit_state{circuit="primary"} 2`) {
+		t.Fatalf("expected open circuit gauge, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultAllowEnv is passed through from the proxy's environment when
+// CleanEnv is set and AllowEnv is empty.
+var defaultAllowEnv = []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
+// Sandbox confines the command's process. Zero values leave each control off;
+// rlimits and User are only supported on Linux.
+type Sandbox struct {
+	// Rlimits, applied to the child right after it starts.
+	CPUSeconds     uint64 `json:"cpuSeconds,omitempty"`
+	AddressSpaceMB uint64 `json:"addressSpaceMB,omitempty"`
+	OpenFiles      uint64 `json:"openFiles,omitempty"`
+	// Processes limits processes per user, so it is most useful with User.
+	Processes uint64 `json:"processes,omitempty"`
+
+	// CleanEnv starts the child with only the AllowEnv variables of the proxy's
+	// environment plus the executor's Env.
+	CleanEnv bool     `json:"cleanEnv,omitempty"`
+	AllowEnv []string `json:"allowEnv,omitempty"`
+
+	// User runs the child as this user and its primary group. The proxy must
+	// run as root.
+	User string `json:"user,omitempty"`
+
+	// DeviceDirs gives every session its own working directory below this one,
+	// created on first use. It takes precedence over WorkDir.
+	DeviceDirs string `json:"deviceDirs,omitempty"`
+}
+
+func (sb Sandbox) hasRlimits() bool {
+	return sb.CPUSeconds > 0 || sb.AddressSpaceMB > 0 || sb.OpenFiles > 0 || sb.Processes > 0
+}
+
+// environ builds the child's environment; nil means inherit the proxy's.
+func (sb Sandbox) environ(extra []string) []string {
+	if !sb.CleanEnv {
+		if len(extra) == 0 {
+			return nil
+		}
+		return append(os.Environ(), extra...)
+	}
+
+	allow := sb.AllowEnv
+	if len(allow) == 0 {
+		allow = defaultAllowEnv
+	}
+	env := make([]string, 0, len(allow)+len(extra))
+	for _, name := range allow {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return append(env, extra...)
+}
+
+// deviceDir returns the session's working directory below DeviceDirs. Session
+// ids are escaped so none can leave the base directory.
+func (sb Sandbox) deviceDir(sessionID string) string {
+	name := url.PathEscape(sessionID)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+
+	return filepath.Join(sb.DeviceDirs, name)
+}
+
+func (sb Sandbox) validate() error {
+	if (sb.hasRlimits() || sb.User != "") && !sandboxSupported {
+		return fmt.Errorf("sandbox: rlimits and user are only supported on linux")
+	}
+	if sb.User != "" {
+		if _, err := lookupCredential(sb.User); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+	}
+	if sb.DeviceDirs != "" && !filepath.IsAbs(sb.DeviceDirs) {
+		return fmt.Errorf("sandbox: deviceDirs must be an absolute path")
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const sandboxSupported = true
+
+// killGroup signals a process group; tests replace it to observe signals.
+var killGroup = syscall.Kill
+
+// rlimitEnv carries the rlimits to the re-executed proxy binary, which sets
+// them on itself and then execs the real command. Setting them from the
+// parent after Start would race with the command's first instructions.
+const rlimitEnv = "CLAWPROXY_SANDBOX_RLIMITS"
+
+func init() {
+	if limits, ok := os.LookupEnv(rlimitEnv); ok {
+		execLimited(limits)
+	}
+}
+
+// execLimited is the body of the re-executed binary: os.Args is the proxy,
+// the command's path, then the command's argv.
+func execLimited(limits string) {
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, rlimitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "clawproxy sandbox: missing command")
+		os.Exit(126)
+	}
+	if err := setRlimits(limits); err != nil {
+		fmt.Fprintf(os.Stderr, "clawproxy sandbox: set rlimits: %v\n", err)
+		os.Exit(126)
+	}
+
+	err := syscall.Exec(os.Args[1], os.Args[2:], env)
+	fmt.Fprintf(os.Stderr, "clawproxy sandbox: exec %s: %v\n", os.Args[1], err)
+	os.Exit(127)
+}
+
+var rlimitResources = []int{unix.RLIMIT_CPU, unix.RLIMIT_AS, unix.RLIMIT_NOFILE, unix.RLIMIT_NPROC}
+
+func (sb Sandbox) rlimits() string {
+	values := []uint64{sb.CPUSeconds, sb.AddressSpaceMB << 20, sb.OpenFiles, sb.Processes}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.FormatUint(v, 10)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func setRlimits(limits string) error {
+	parts := strings.Split(limits, ",")
+	if len(parts) != len(rlimitResources) {
+		return fmt.Errorf("malformed %s %q", rlimitEnv, limits)
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed %s %q", rlimitEnv, limits)
+		}
+		if v == 0 {
+			continue
+		}
+		if err := unix.Setrlimit(rlimitResources[i], &unix.Rlimit{Cur: v, Max: v}); err != nil {
+			return fmt.Errorf("rlimit %d: %w", rlimitResources[i], err)
+		}
+	}
+
+	return nil
+}
+
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("look up user %s: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse uid of %s: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse gid of %s: %w", name, err)
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// prepare runs the command in its own process group, which gets SIGTERM when
+// the context ends and SIGKILL after the grace period, and applies the user,
+// per-device directory and rlimits. The returned release must be called once
+// the command has been waited for; if the group was signalled, it kills what
+// is left of it at once, since members that ignored SIGTERM and closed their
+// output would otherwise outlive the command.
+func (sb Sandbox) prepare(cmd *exec.Cmd, sessionID string, grace time.Duration) (func(), error) {
+	var mu sync.Mutex
+	var kill *time.Timer
+	released := false
+	signal := killGroup
+	release := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		released = true
+		if kill != nil && kill.Stop() {
+			_ = signal(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		mu.Lock()
+		if !released {
+			kill = time.AfterFunc(grace, func() {
+				_ = signal(pgid, syscall.SIGKILL)
+			})
+		}
+		mu.Unlock()
+		return signal(pgid, syscall.SIGTERM)
+	}
+	// Stop waiting on pipes held open by stray children once the group has
+	// had its SIGKILL.
+	cmd.WaitDelay = grace + time.Second
+
+	var cred *syscall.Credential
+	if sb.User != "" {
+		var err error
+		if cred, err = lookupCredential(sb.User); err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	if sb.DeviceDirs != "" {
+		dir := sb.deviceDir(sessionID)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create device dir: %w", err)
+		}
+		if cred != nil {
+			if err := os.Chown(dir, int(cred.Uid), int(cred.Gid)); err != nil {
+				return nil, fmt.Errorf("chown device dir: %w", err)
+			}
+		}
+		cmd.Dir = dir
+	}
+
+	if sb.hasRlimits() && cmd.Err == nil {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("locate proxy binary: %w", err)
+		}
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, rlimitEnv+"="+sb.rlimits())
+		cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+		cmd.Path = self
+	}
+
+	return release, nil
+}
+
+// chown hands a file the proxy created for the command to the sandbox user.
+func (sb Sandbox) chown(path string) error {
+	if sb.User == "" {
+		return nil
+	}
+	cred, err := lookupCredential(sb.User)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("chown %s: %w", path, err)
+	}
+
+	return nil
+}
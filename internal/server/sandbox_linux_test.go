@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTemplateExecutorRun_Sandbox(t *testing.T) {
+	base := t.TempDir()
+	e := TemplateExecutor{
+		Binary:  "sh",
+		Args:    []string{"-c", `printf '%s %s' "$(ulimit -n)" "$(pwd)"`},
+		Sandbox: Sandbox{OpenFiles: 64, DeviceDirs: base},
+	}
+	if err := e.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	out, err := e.Run(context.Background(), "acme:dev-1", "hello")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	dir := filepath.Join(base, "acme:dev-1")
+	if out != "64 "+dir {
+		t.Fatalf("expected open files limit and device dir, got %q", out)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected 0700 device dir, got %v %v", info, err)
+	}
+}
+
+func TestTemplateExecutorRun_KillsProcessGroup(t *testing.T) {
+	e := TemplateExecutor{Binary: "sh", Args: []string{"-c", "sleep 30 & wait"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := e.Run(ctx, "dev-1", "hello")
+	if err == nil {
+		t.Fatal("expected canceled command to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the whole process group to be killed, took %s", elapsed)
+	}
+}
+
+func TestSandboxValidate_UnknownUser(t *testing.T) {
+	err := Sandbox{User: "clawproxy-no-such-user"}.validate()
+	if err == nil || !strings.Contains(err.Error(), "clawproxy-no-such-user") {
+		t.Fatalf("expected unknown user error, got %v", err)
+	}
+}
+
+func TestTemplateExecutorRun_TermBeforeKill(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		output string
+	}{
+		{name: "exits on term", script: `trap 'printf term; exit 0' TERM; sleep 30 & wait`, output: "term"},
+		{name: "ignores term", script: `trap '' TERM; printf partial; sleep 30`, output: "partial"},
+	}
+	for _, tt := range tests {
+		e := TemplateExecutor{Binary: "sh", Args: []string{"-c", tt.script}}
+		ctx, cancel := context.WithTimeout(withKillGrace(context.Background(), 300*time.Millisecond), 200*time.Millisecond)
+
+		start := time.Now()
+		out, err := e.Run(ctx, "dev-1", "hello")
+		cancel()
+		if err == nil {
+			t.Fatalf("%s: expected canceled command to fail", tt.name)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("%s: expected the command to be killed after the grace period, took %s", tt.name, elapsed)
+		}
+		if out != tt.output {
+			t.Fatalf("%s: expected output %q, got %q", tt.name, tt.output, out)
+		}
+	}
+}
+
+func TestTemplateExecutorRun_KillsGroupLeftAfterExit(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	script := `trap 'exit 0' TERM; (trap '' TERM; exec sh -c 'echo $$ > "$0"; exec sleep 30' "$1" </dev/null >/dev/null 2>&1) & while [ ! -s "$1" ]; do sleep 0.01; done; wait`
+	e := TemplateExecutor{Binary: "sh", Args: []string{"-c", script, "sh", pidFile}}
+	ctx, cancel := context.WithTimeout(withKillGrace(context.Background(), 10*time.Second), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	e.Run(ctx, "dev-1", "hello")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the command to be waited for before the grace period, took %s", elapsed)
+	}
+
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("read child pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		t.Fatalf("parse child pid %q: %v", raw, err)
+	}
+	t.Cleanup(func() { syscall.Kill(pid, syscall.SIGKILL) })
+	stat := filepath.Join("/proc", strconv.Itoa(pid), "stat")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		// Orphans may stay zombies when nothing reaps them; those are dead too.
+		fields := strings.Fields(readFileOrEmpty(stat))
+		if len(fields) < 3 || fields[2] == "Z" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the child ignoring SIGTERM to be killed, still %s", fields[2])
+		}
+	}
+}
+
+func readFileOrEmpty(file string) string {
+	raw, _ := os.ReadFile(file)
+	return string(raw)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const sandboxSupported = false
+
+func lookupCredential(string) (struct{}, error) {
+	return struct{}{}, errors.New("running as another user is only supported on linux")
+}
+
+// prepare applies the per-device directory; process groups, users, rlimits
+// and the SIGTERM grace period are Linux-only.
+func (sb Sandbox) prepare(cmd *exec.Cmd, sessionID string, _ time.Duration) (func(), error) {
+	if sb.DeviceDirs != "" {
+		dir := sb.deviceDir(sessionID)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create device dir: %w", err)
+		}
+		cmd.Dir = dir
+	}
+
+	return func() {}, nil
+}
+
+func (sb Sandbox) chown(string) error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandboxEnviron_Clean(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+	t.Setenv("CLAWPROXY_SECRET_TEST", "leak")
+
+	env := Sandbox{CleanEnv: true}.environ([]string{"FOO=bar"})
+	joined := strings.Join(env, "\n")
+	if strings.Contains(joined, "CLAWPROXY_SECRET_TEST") {
+		t.Fatalf("expected proxy secret to be dropped, got %q", env)
+	}
+	if !strings.Contains(joined, "PATH=/usr/bin:/bin") || !strings.Contains(joined, "FOO=bar") {
+		t.Fatalf("expected PATH and FOO to be kept, got %q", env)
+	}
+
+	env = Sandbox{CleanEnv: true, AllowEnv: []string{"CLAWPROXY_SECRET_TEST"}}.environ(nil)
+	if len(env) != 1 || env[0] != "CLAWPROXY_SECRET_TEST=leak" {
+		t.Fatalf("expected only the allowlisted variable, got %q", env)
+	}
+	if env := (Sandbox{}).environ(nil); env != nil {
+		t.Fatalf("expected inherited environment, got %q", env)
+	}
+}
+
+func TestSandboxDeviceDir_Escapes(t *testing.T) {
+	sb := Sandbox{DeviceDirs: "/var/lib/clawproxy"}
+	tests := map[string]string{
+		"dev-1":      "dev-1",
+		"acme:dev-1": "acme:dev-1",
+		"../etc":     "%2E.%2Fetc",
+		"..":         "%2E.",
+		"a/b":        "a%2Fb",
+	}
+	for id, want := range tests {
+		if got := sb.deviceDir(id); got != filepath.Join(sb.DeviceDirs, want) {
+			t.Fatalf("%q: expected %s, got %s", id, filepath.Join(sb.DeviceDirs, want), got)
+		}
+	}
+}
+
+func TestRun_RejectsInvalidSandbox(t *testing.T) {
+	for name, sb := range map[string]Sandbox{
+		"relative deviceDirs": {DeviceDirs: "sessions"},
+		"unknown user":        {User: "clawproxy-no-such-user"},
+	} {
+		executor := RetryExecutor{Next: OpenClawExecutor{Sandbox: sb}}
+		srv := NewWithExecutor(":0", testJWTSecret, executor, WithListeners(ListenerConfig{Addr: "127.0.0.1:0"}))
+		if err := srv.Run(); err == nil || !strings.Contains(err.Error(), "sandbox") {
+			t.Fatalf("%s: expected Run to reject the sandbox, got %v", name, err)
+		}
+	}
+}
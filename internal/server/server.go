@@ -1,18 +1,22 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os/exec"
 	"strings"
-	"sync"
 	"time"
 
 	"clawproxy/internal/auth"
+	"clawproxy/internal/metrics"
+	"clawproxy/internal/pairing"
+	"clawproxy/internal/proxyproto"
+	"clawproxy/internal/ratelimit"
+	"clawproxy/internal/webhook"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -23,44 +27,78 @@ var (
 	wsPingPeriod = 10 * time.Second
 )
 
+const wsCloseTokenExpired = 4001
+
 type CommandExecutor interface {
 	Run(ctx context.Context, deviceID, message string) (string, error)
 }
 
-type OpenClawExecutor struct{}
+// StreamingExecutor is implemented by executors that can hand out stdout while
+// the command is still running. Run must return the same output RunStream
+// would have passed to onOutput in total.
+type StreamingExecutor interface {
+	CommandExecutor
+	RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error)
+}
+
+// OpenClawExecutor runs the openclaw CLI. The zero value runs "openclaw" from
+// PATH with the proxy's environment and working directory.
+type OpenClawExecutor struct {
+	Binary  string   `json:"binary,omitempty"`
+	Agent   string   `json:"agent,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	WorkDir string   `json:"workDir,omitempty"`
+	Sandbox Sandbox  `json:"sandbox,omitempty"`
+}
 
 type wsRequest struct {
-	Message string `json:"message"`
+	Type        string         `json:"type,omitempty"`
+	Message     string         `json:"message"`
+	Token       string         `json:"token,omitempty"`
+	CallbackURL string         `json:"callbackUrl,omitempty"`
+	Options     map[string]any `json:"options,omitempty"`
+	// TimeoutSeconds asks for a timeout other than the default.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// IdempotencyKey makes a resent message reuse the first run's reply.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
-func (e OpenClawExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
-	log.Printf("[executor] start openclaw command session_id=%s", deviceID)
-	cmd := buildOpenClawCommand(ctx, deviceID, message)
+type wsError struct {
+	Type  string `json:"type"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	// ResetAt is a unix timestamp telling the client when to retry.
+	ResetAt int64 `json:"resetAt,omitempty"`
+	// Output is the command's stdout so far when it timed out.
+	Output string `json:"output,omitempty"`
+}
 
-	var stdoutBuffer bytes.Buffer
-	var stderrBuffer bytes.Buffer
-	cmd.Stdout = &stdoutBuffer
-	cmd.Stderr = &stderrBuffer
+func (e OpenClawExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.Template().Run(ctx, deviceID, message)
+}
 
-	err := cmd.Run()
-	stdout := stdoutBuffer.String()
-	stderr := stderrBuffer.String()
+func (e OpenClawExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	return e.Template().RunStream(ctx, deviceID, message, onOutput)
+}
 
-	if stderr != "" {
-		log.Printf("[executor] openclaw command warning/error output session_id=%s stderr=%q", deviceID, stderr)
+// Template returns the built-in openclaw command template with e applied.
+func (e OpenClawExecutor) Template() TemplateExecutor {
+	t := TemplateExecutor{Binary: e.Binary, Env: e.Env, WorkDir: e.WorkDir, Sandbox: e.Sandbox}
+	if t.Binary == "" {
+		t.Binary = "openclaw"
 	}
-
-	if err != nil {
-		log.Printf("[executor] openclaw command failed session_id=%s err=%v", deviceID, err)
-		return stdout, fmt.Errorf("run openclaw agent command: %w", err)
+	t.Args = append(t.Args, DefaultCommandArgs[0])
+	if e.Agent != "" {
+		t.Args = append(t.Args, "--agent", literalArg(e.Agent))
 	}
-
-	log.Printf("[executor] openclaw command finished session_id=%s output_bytes=%d", deviceID, len(stdout))
-	return stdout, nil
+	t.Args = append(t.Args, DefaultCommandArgs[1:]...)
+	return t
 }
 
 func buildOpenClawCommand(ctx context.Context, deviceID, message string) *exec.Cmd {
-	return exec.CommandContext(ctx, "openclaw", "agent", "--session-id", deviceID, "--message", message, "--json")
+	// The built-in template always renders.
+	cmd, _, _ := OpenClawExecutor{}.Template().command(ctx, CommandData{DeviceID: deviceID, Message: message})
+	return cmd
 }
 
 func extractJSONObject(raw string) (string, error) {
@@ -97,62 +135,317 @@ type Server struct {
 	jwtSecret []byte
 	executor  CommandExecutor
 	upgrader  websocket.Upgrader
+	tickets   *ticketStore
+	origins   *OriginAllowlist
+	metrics   *metrics.Registry
+	pairings  *pairing.Store
+	listeners []ListenerConfig
+	readiness readiness
+	ipFilter  *IPFilter
+	lockouts  *lockoutTracker
+	limiter   *ratelimit.Limiter
+	limits    ratelimit.Limits
+	// trustedProxies may set X-Forwarded-For / X-Real-IP and send PROXY headers.
+	trustedProxies []*net.IPNet
+	tenants        map[string]*tenant
+	sessions       *sessionLocks
+	streams        *streamStore
+	options        map[string]OptionRule
+	webhooks       WebhookConfig
+	deliveries     *webhook.Dispatcher
+	timeouts       TimeoutConfig
+	idempotency    *idempotencyStore
+}
+
+type Option func(*Server)
+
+// WithOriginAllowlist restricts which browser origins may open /ws.
+func WithOriginAllowlist(origins *OriginAllowlist) Option {
+	return func(s *Server) {
+		s.origins = origins
+	}
+}
+
+// WithPairingStore replaces the default in-memory pairing store.
+func WithPairingStore(store *pairing.Store) Option {
+	return func(s *Server) {
+		s.pairings = store
+	}
+}
+
+// WithListeners replaces the default plain-HTTP JWT listener on addr.
+func WithListeners(listeners ...ListenerConfig) Option {
+	return func(s *Server) {
+		s.listeners = listeners
+	}
+}
+
+// WithIPFilter restricts which client addresses may attempt a /ws handshake.
+func WithIPFilter(filter *IPFilter) Option {
+	return func(s *Server) {
+		s.ipFilter = filter
+	}
+}
+
+// WithLockout overrides DefaultLockoutConfig.
+func WithLockout(cfg LockoutConfig) Option {
+	return func(s *Server) {
+		s.lockouts = newLockoutTracker(cfg)
+	}
+}
+
+// WithLimits sets the default per-device rate limit and daily quota. Token
+// claims can override them per device.
+func WithLimits(limits ratelimit.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithTrustedProxies sets the reverse proxies whose forwarding headers are
+// believed when resolving the client IP. By default no proxy is trusted.
+func WithTrustedProxies(proxies []*net.IPNet) Option {
+	return func(s *Server) {
+		s.trustedProxies = proxies
+	}
+}
+
+// WithExecutor replaces the default OpenClawExecutor.
+func WithExecutor(executor CommandExecutor) Option {
+	return func(s *Server) {
+		s.executor = executor
+	}
+}
+
+// WithTenants registers tenants selected by the tenant token claim.
+func WithTenants(tenants ...TenantConfig) Option {
+	return func(s *Server) {
+		for _, cfg := range tenants {
+			s.tenants[cfg.ID] = newTenant(cfg)
+		}
+	}
 }
 
-func New(addr, jwtSecret string) *Server {
-	return &Server{
-		addr:      addr,
-		jwtSecret: []byte(jwtSecret),
-		executor:  OpenClawExecutor{},
-		upgrader:  websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+func New(addr, jwtSecret string, opts ...Option) *Server {
+	pairings, _ := pairing.NewStore("")
+
+	s := &Server{
+		addr:        addr,
+		jwtSecret:   []byte(jwtSecret),
+		executor:    OpenClawExecutor{},
+		tickets:     newTicketStore(wsTicketTTL),
+		origins:     &OriginAllowlist{},
+		metrics:     metrics.NewRegistry(),
+		pairings:    pairings,
+		listeners:   []ListenerConfig{{Addr: addr}},
+		ipFilter:    &IPFilter{},
+		lockouts:    newLockoutTracker(DefaultLockoutConfig),
+		limiter:     ratelimit.New(),
+		tenants:     make(map[string]*tenant),
+		sessions:    newSessionLocks(),
+		streams:     newStreamStore(streamRetention),
+		deliveries:  webhook.NewDispatcher(webhook.DefaultConfig),
+		idempotency: newIdempotencyStore(defaultIdempotencyTTL),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.origins.Allowed}
+	s.deliveries.Observe = func(status string) {
+		s.metrics.Inc("clawproxy_webhook_deliveries_total", "status", status)
 	}
+	s.readiness.add("circuits", s.checkCircuits)
+	s.describeMetrics()
+	return s
 }
 
-func NewWithExecutor(addr, jwtSecret string, executor CommandExecutor) *Server {
-	s := New(addr, jwtSecret)
+func NewWithExecutor(addr, jwtSecret string, executor CommandExecutor, opts ...Option) *Server {
+	s := New(addr, jwtSecret, opts...)
 	s.executor = executor
 	return s
 }
 
-func (s *Server) validateToken(tokenStr string) error {
-	return auth.ValidateToken(s.jwtSecret, tokenStr)
+func (s *Server) describeMetrics() {
+	s.metrics.Describe("clawproxy_ws_origin_rejected_total", metrics.KindCounter, "WebSocket handshakes and device requests rejected by the origin allowlist.")
+	s.metrics.Describe("clawproxy_ws_ip_rejected_total", metrics.KindCounter, "WebSocket handshakes and device requests rejected by the CIDR allow/deny list.")
+	s.metrics.Describe("clawproxy_auth_failures_total", metrics.KindCounter, "Failed authentication attempts counted towards lockouts.")
+	s.metrics.Describe("clawproxy_auth_lockout_rejected_total", metrics.KindCounter, "Requests rejected while the client or device was locked out.")
+	s.metrics.Describe("clawproxy_rate_limited_total", metrics.KindCounter, "Messages rejected by the per-device rate limit or daily quota.")
+	s.metrics.Describe("clawproxy_webhook_deliveries_total", metrics.KindCounter, "Webhook delivery attempts by outcome: delivered, pending (retrying) or dead.")
+	s.metrics.Describe("clawproxy_idempotent_requests_total", metrics.KindCounter, "Requests answered from an earlier run with the same idempotency key: cached reply or attached to a running one.")
+	s.metrics.Describe("clawproxy_circuit_state", metrics.KindGauge, "Executor circuit breaker state: 0 closed, 1 half-open, 2 open.")
+	s.metrics.Describe("clawproxy_workers", metrics.KindGauge, "Worker pool processes by state: busy or idle.")
+	s.metrics.Describe("clawproxy_worker_events_total", metrics.KindCounter, "Worker pool processes spawned, recycled after maxRequests, crashed or stopped for being idle.")
+}
+
+func (s *Server) handleMetrics(c *gin.Context) {
+	s.updateCircuitMetrics()
+	s.updateWorkerMetrics()
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	if _, err := s.metrics.WriteTo(c.Writer); err != nil {
+		log.Printf("[server] write metrics failed err=%v", err)
+	}
 }
 
 func (s *Server) Engine() *gin.Engine {
 	r := gin.Default()
+	proxies := make([]string, 0, len(s.trustedProxies))
+	for _, n := range s.trustedProxies {
+		proxies = append(proxies, n.String())
+	}
+	if len(proxies) == 0 {
+		proxies = nil
+	}
+	// The values come from ParseCIDRs, so gin cannot reject them.
+	_ = r.SetTrustedProxies(proxies)
+
+	// /ws needs only a valid token for the device; each message type declares its
+	// own scope in wsMessageScopes.
 	r.GET("/ws", s.handleWS)
+	r.POST("/v1/ws-ticket", s.requireScope(""), s.handleWSTicket)
+	r.GET("/metrics", s.requireScope(auth.ScopeAdmin), s.handleMetrics)
+	r.GET("/readyz", s.handleReadyz)
+	r.POST("/v1/pair", s.handleExchangePairing)
+	r.GET("/v1/devices/:deviceId/usage", s.handleDeviceUsage)
+	// gin cannot route "messages:stream" beside "messages", so POSTs under a
+	// device are dispatched on the last segment.
+	r.POST("/v1/devices/:deviceId/:action", s.handleDeviceAction)
+	r.POST("/v1/chat/completions", s.handleChatCompletions)
+
+	admin := r.Group("/v1/admin", s.requireScope(auth.ScopeAdmin))
+	admin.POST("/pairings", s.handleCreatePairing)
+	admin.GET("/pairings", s.handleListPairings)
+	admin.DELETE("/pairings/:id", s.handleRevokePairing)
+	admin.GET("/lockouts", s.handleListLockouts)
+	admin.DELETE("/lockouts/:key", s.handleClearLockout)
+	admin.GET("/usage", s.handleListUsage)
+	admin.GET("/webhooks", s.handleListWebhooks)
+	admin.POST("/webhooks/:id/retry", s.handleRetryWebhook)
+	admin.DELETE("/webhooks/:id", s.handleDiscardWebhook)
 	return r
 }
 
 func (s *Server) Run() error {
-	log.Printf("[server] starting websocket server addr=%s", s.addr)
-	return s.Engine().Run(s.addr)
+	executors := []CommandExecutor{s.executor}
+	if err := s.timeouts.Validate(); err != nil {
+		return err
+	}
+	for name, rule := range s.options {
+		if err := rule.Validate(name); err != nil {
+			return err
+		}
+	}
+	for _, t := range s.tenants {
+		if err := t.cfg.Validate(); err != nil {
+			return err
+		}
+		executors = append(executors, t.executor)
+	}
+	for _, executor := range executors {
+		if err := validateExecutor(executor); err != nil {
+			return err
+		}
+	}
+
+	engine := s.Engine()
+	servers := make([]*http.Server, 0, len(s.listeners))
+	var reloaders []*certReloader
+	for _, l := range s.listeners {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+		if l.ProxyProtocol && len(s.trustedProxies) == 0 {
+			return fmt.Errorf("listener %s: proxyProtocol requires trusted proxies", l.Addr)
+		}
+
+		srv := &http.Server{Addr: l.Addr, Handler: l.handler(engine)}
+		if l.TLSCert != "" {
+			certs, err := newCertReloader(l.TLSCert, l.TLSKey)
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+			if srv.TLSConfig, err = l.tlsConfig(certs); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+			s.readiness.add("tls "+l.Addr, certs.check)
+			reloaders = append(reloaders, certs)
+		}
+		servers = append(servers, srv)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if len(reloaders) > 0 {
+		go watchCertificates(reloaders, done)
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		l := s.listeners[i]
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return fmt.Errorf("listen %s: %w", l.Addr, err)
+		}
+		if l.ProxyProtocol {
+			ln = proxyproto.NewListener(ln, s.trustedProxies)
+		}
+
+		go func(srv *http.Server, ln net.Listener) {
+			log.Printf("[server] starting websocket server addr=%s tls=%t auth_mode=%s proxy_protocol=%t", l.Addr, srv.TLSConfig != nil, l.mode(), l.ProxyProtocol)
+			if srv.TLSConfig != nil {
+				errCh <- fmt.Errorf("serve tls %s: %w", l.Addr, srv.ServeTLS(ln, "", ""))
+				return
+			}
+			errCh <- fmt.Errorf("serve %s: %w", l.Addr, srv.Serve(ln))
+		}(srv, ln)
+	}
+
+	return <-errCh
+}
+
+// validateExecutor checks e and every executor it wraps.
+func validateExecutor(e CommandExecutor) error {
+	if o, ok := e.(OpenClawExecutor); ok {
+		e = o.Template()
+	}
+	if v, ok := e.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	if w, ok := e.(wrapper); ok {
+		for _, inner := range w.wrapped() {
+			if err := validateExecutor(inner); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 func (s *Server) handleWS(c *gin.Context) {
 	clientIP := c.ClientIP()
 	deviceID := c.Query("deviceId")
+	if deviceID == "" {
+		if certClaims := certificateClaims(c.Request, requestListener(c.Request)); certClaims != nil {
+			deviceID = certClaims.Subject
+		}
+	}
 	if deviceID == "" {
 		log.Printf("[server] reject websocket request: missing deviceId client_ip=%s", clientIP)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "deviceId is required"})
 		return
 	}
-	token := c.GetHeader("Authorization")
-	if token == "" {
-		log.Printf("[server] reject websocket request: missing Authorization header session_id=%s client_ip=%s", deviceID, clientIP)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": "TOKEN_REQUIRED", "error": "token is required"})
-		return
-	}
-
-	if err := s.validateToken(token); err != nil {
-		log.Printf("[server] reject websocket request: invalid token session_id=%s client_ip=%s err=%v", deviceID, clientIP, err)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": "INVALID_TOKEN", "error": "token validation failed"})
+	claims, ok := s.admitDevice(c, deviceID, "")
+	if !ok {
 		return
 	}
 
 	connectedAt := time.Now().Format(time.RFC3339)
 	log.Printf("[server] websocket upgrade requested session_id=%s client_ip=%s at=%s", deviceID, clientIP, connectedAt)
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, wsSubprotocolHeader(c.Request))
 	if err != nil {
 		log.Printf("[server] websocket upgrade failed session_id=%s err=%v", deviceID, err)
 		return
@@ -168,21 +461,10 @@ func (s *Server) handleWS(c *gin.Context) {
 		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
 	})
 
-	var writeMu sync.Mutex
-	writeMessage := func(messageType int, data []byte) error {
-		writeMu.Lock()
-		defer writeMu.Unlock()
-
-		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
-			return fmt.Errorf("set write deadline: %w", err)
-		}
-
-		if err := conn.WriteMessage(messageType, data); err != nil {
-			return fmt.Errorf("write websocket message: %w", err)
-		}
-
-		return nil
-	}
+	session := &wsSession{conn: conn, deviceID: deviceID, claims: claims}
+	writeMessage := session.writeMessage
+	session.scheduleExpiry(claims.Expiry())
+	defer session.stopExpiry()
 
 	done := make(chan struct{})
 	go func() {
@@ -219,6 +501,32 @@ func (s *Server) handleWS(c *gin.Context) {
 			}
 			continue
 		}
+		if req.Type == "" {
+			req.Type = wsTypeMessage
+		}
+		requiredScope, known := wsMessageScopes[req.Type]
+		if !known {
+			log.Printf("[server] unknown websocket message type session_id=%s type=%q", deviceID, req.Type)
+			if writeErr := session.writeError("INVALID_REQUEST", "unknown message type: "+req.Type); writeErr != nil {
+				log.Printf("[server] write websocket error failed session_id=%s err=%v", deviceID, writeErr)
+				return
+			}
+			continue
+		}
+		if !session.claims.HasScope(requiredScope) {
+			log.Printf("[server] websocket message rejected: insufficient scope session_id=%s type=%s required=%s", deviceID, req.Type, requiredScope)
+			if writeErr := session.writeError("FORBIDDEN", "insufficient scope: "+requiredScope+" required"); writeErr != nil {
+				log.Printf("[server] write websocket error failed session_id=%s err=%v", deviceID, writeErr)
+				return
+			}
+			continue
+		}
+		if req.Type == wsTypeReauth {
+			if !s.handleReauth(session, req.Token) {
+				return
+			}
+			continue
+		}
 		if req.Message == "" {
 			log.Printf("[server] empty message in websocket payload session_id=%s", deviceID)
 			if writeErr := writeMessage(websocket.TextMessage, []byte("message is required")); writeErr != nil {
@@ -227,24 +535,27 @@ func (s *Server) handleWS(c *gin.Context) {
 			}
 			continue
 		}
-
-		log.Printf("[server] received websocket payload session_id=%s message_len=%d", deviceID, len(req.Message))
-		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
-		output, runErr := s.executor.Run(ctx, deviceID, req.Message)
-		cancel()
-
-		if output != "" {
-			log.Printf("[server] full command output session_id=%s: %s", deviceID, output)
+		if req.CallbackURL != "" {
+			if err := s.checkCallbackURL(session.claims, req.CallbackURL); err != nil {
+				if writeErr := session.writeError("INVALID_REQUEST", err.Error()); writeErr != nil {
+					log.Printf("[server] write websocket error failed session_id=%s err=%v", deviceID, writeErr)
+					return
+				}
+				continue
+			}
 		}
 
+		log.Printf("[server] received websocket payload session_id=%s message_len=%d", deviceID, len(req.Message))
+		jsonPayload, runErr := s.runMessage(c.Request.Context(), session.claims, deviceID, req.Message, runOptions{callbackURL: req.CallbackURL, options: req.Options, timeoutSeconds: req.TimeoutSeconds, idempotencyKey: req.IdempotencyKey})
 		if runErr != nil {
-			log.Printf("[server] executor failed session_id=%s err=%v", deviceID, runErr)
-			continue
-		}
-
-		jsonPayload, extractErr := extractJSONObject(output)
-		if extractErr != nil {
-			log.Printf("[server] failed to extract json from output session_id=%s err=%v", deviceID, extractErr)
+			// Messages refused before running, timeouts and open circuits get
+			// an error frame; executor failures are only logged.
+			if msgErr := asMessageError(runErr); msgErr.Status < http.StatusInternalServerError || msgErr.Code == "TIMEOUT" || msgErr.Code == "UPSTREAM_UNAVAILABLE" {
+				if writeErr := session.writeJSON(msgErr.frame()); writeErr != nil {
+					log.Printf("[server] write websocket error failed session_id=%s err=%v", deviceID, writeErr)
+					return
+				}
+			}
 			continue
 		}
 
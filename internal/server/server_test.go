@@ -250,3 +250,53 @@ func TestHandleWS_MissingToken_WebSocketHandshake(t *testing.T) {
 		t.Fatalf("parse request url: %v", err)
 	}
 }
+
+func TestHandleWS_TokenForOtherDevice(t *testing.T) {
+	exec := &fakeExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	r := srv.Engine()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?deviceId=device-2", nil)
+	req.Header.Set("Authorization", mustCreateToken(t))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "FORBIDDEN") {
+		t.Fatalf("unexpected response body: %s", w.Body.String())
+	}
+}
+
+func TestHandleWS_MessageRequiresChatScope(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	token, err := auth.GenerateToken([]byte(testJWTSecret), "device-1", time.Hour, auth.ScopePush)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, token)
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+
+	var resp wsError
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read websocket message: %v", err)
+	}
+	if resp.Code != "FORBIDDEN" {
+		t.Fatalf("expected FORBIDDEN error frame, got %+v", resp)
+	}
+	if len(exec.gotMessages) != 0 {
+		t.Fatalf("executor should not run without chat scope, got %#v", exec.gotMessages)
+	}
+}
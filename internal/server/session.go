@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsTypeMessage = "message"
+	wsTypeReauth  = "reauth"
+)
+
+// wsMessageScopes declares the scope each websocket message type requires.
+var wsMessageScopes = map[string]string{
+	wsTypeMessage: auth.ScopeChat,
+	wsTypeReauth:  "",
+}
+
+type wsReauthResponse struct {
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	ExpiresAt *int64 `json:"expiresAt,omitempty"`
+}
+
+// wsSession holds the per-connection state of an upgraded /ws request.
+type wsSession struct {
+	conn     *websocket.Conn
+	deviceID string
+	claims   *auth.Claims
+
+	writeMu sync.Mutex
+
+	expiryMu    sync.Mutex
+	expiryTimer *time.Timer
+}
+
+func (ws *wsSession) writeMessage(messageType int, data []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return fmt.Errorf("set write deadline: %w", err)
+	}
+
+	if err := ws.conn.WriteMessage(messageType, data); err != nil {
+		return fmt.Errorf("write websocket message: %w", err)
+	}
+
+	return nil
+}
+
+func (ws *wsSession) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal websocket message: %w", err)
+	}
+
+	return ws.writeMessage(websocket.TextMessage, data)
+}
+
+func (ws *wsSession) writeError(code, message string) error {
+	return ws.writeJSON(wsError{Type: "error", Code: code, Error: message})
+}
+
+// scheduleExpiry closes the connection with TOKEN_EXPIRED once expiresAt passes.
+// A zero expiresAt means the token never expires.
+func (ws *wsSession) scheduleExpiry(expiresAt time.Time) {
+	ws.expiryMu.Lock()
+	defer ws.expiryMu.Unlock()
+
+	if ws.expiryTimer != nil {
+		ws.expiryTimer.Stop()
+		ws.expiryTimer = nil
+	}
+	if expiresAt.IsZero() {
+		return
+	}
+
+	ws.expiryTimer = time.AfterFunc(time.Until(expiresAt), ws.closeExpired)
+}
+
+func (ws *wsSession) stopExpiry() {
+	ws.scheduleExpiry(time.Time{})
+}
+
+func (ws *wsSession) closeExpired() {
+	log.Printf("[server] token expired, closing websocket session_id=%s", ws.deviceID)
+	closeMessage := websocket.FormatCloseMessage(wsCloseTokenExpired, "TOKEN_EXPIRED")
+	if err := ws.writeMessage(websocket.CloseMessage, closeMessage); err != nil {
+		log.Printf("[server] write token expired close frame failed session_id=%s err=%v", ws.deviceID, err)
+	}
+	_ = ws.conn.Close()
+}
+
+// handleReauth replaces the token of a live connection. It returns false when
+// the connection can no longer be written to.
+func (s *Server) handleReauth(ws *wsSession, token string) bool {
+	if token == "" {
+		log.Printf("[server] reauth rejected: missing token session_id=%s", ws.deviceID)
+		return ws.writeError("TOKEN_REQUIRED", "token is required") == nil
+	}
+
+	claims, err := s.validateToken(token)
+	if err != nil {
+		log.Printf("[server] reauth rejected: invalid token session_id=%s err=%v", ws.deviceID, err)
+		code := "INVALID_TOKEN"
+		if errors.Is(err, auth.ErrTokenExpired) {
+			code = "TOKEN_EXPIRED"
+		}
+		return ws.writeError(code, "token validation failed") == nil
+	}
+	if claims.Subject != ws.claims.Subject || claims.Tenant != ws.claims.Tenant {
+		log.Printf("[server] reauth rejected: subject mismatch session_id=%s", ws.deviceID)
+		return ws.writeError("INVALID_TOKEN", "token subject does not match connection") == nil
+	}
+
+	ws.claims = claims
+	ws.scheduleExpiry(claims.Expiry())
+	log.Printf("[server] reauth succeeded session_id=%s", ws.deviceID)
+	if err := ws.writeJSON(wsReauthResponse{Type: wsTypeReauth, Status: "ok", ExpiresAt: claims.ExpiresAt}); err != nil {
+		log.Printf("[server] write reauth response failed session_id=%s err=%v", ws.deviceID, err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clawproxy/internal/auth"
+	"github.com/gorilla/websocket"
+)
+
+func mustCreateTokenWithExpiry(t *testing.T, subject string, expiresIn time.Duration) string {
+	t.Helper()
+	tokenString, err := auth.GenerateToken([]byte(testJWTSecret), subject, expiresIn)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	return tokenString
+}
+
+func TestHandleWS_ClosesOnTokenExpiry(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateTokenWithExpiry(t, "device-1", 2*time.Second))
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(4 * time.Second))
+	_, _, err := conn.ReadMessage()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("expected close error, got %v", err)
+	}
+	if closeErr.Code != wsCloseTokenExpired || closeErr.Text != "TOKEN_EXPIRED" {
+		t.Fatalf("unexpected close frame code=%d text=%q", closeErr.Code, closeErr.Text)
+	}
+}
+
+func TestHandleWS_ReauthExtendsConnection(t *testing.T) {
+	exec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateTokenWithExpiry(t, "device-1", 2*time.Second))
+	defer conn.Close()
+
+	fresh := mustCreateTokenWithExpiry(t, "device-1", time.Hour)
+	if err := conn.WriteJSON(wsRequest{Type: wsTypeReauth, Token: fresh}); err != nil {
+		t.Fatalf("write reauth message: %v", err)
+	}
+
+	var resp wsReauthResponse
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read reauth response: %v", err)
+	}
+	if resp.Status != "ok" || resp.ExpiresAt == nil {
+		t.Fatalf("unexpected reauth response: %+v", resp)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read websocket message after reauth: %v", err)
+	}
+	if string(message) != `{"result":"ok"}` {
+		t.Fatalf("unexpected websocket message: %s", message)
+	}
+}
+
+func TestHandleWS_ReauthRejectsOtherSubject(t *testing.T) {
+	exec := &fakeExecutor{}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateToken(t))
+	defer conn.Close()
+
+	other := mustCreateTokenWithExpiry(t, "device-2", time.Hour)
+	if err := conn.WriteJSON(wsRequest{Type: wsTypeReauth, Token: other}); err != nil {
+		t.Fatalf("write reauth message: %v", err)
+	}
+
+	var resp wsError
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("read reauth response: %v", err)
+	}
+	if resp.Code != "INVALID_TOKEN" {
+		t.Fatalf("expected INVALID_TOKEN, got %+v", resp)
+	}
+}
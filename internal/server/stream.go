@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"clawproxy/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// streamRetention is how long a finished stream can still be resumed.
+	streamRetention = 10 * time.Minute
+	sseKeepalive    = 15 * time.Second
+)
+
+// Server-sent event names.
+const (
+	sseEventProgress = "progress"
+	sseEventChunk    = "chunk"
+	sseEventResult   = "result"
+	sseEventError    = "error"
+)
+
+type streamEvent struct {
+	seq   int
+	event string
+	data  []byte
+}
+
+// streamRun records the events of one streamed message so a client that lost
+// the connection can resume it with Last-Event-ID.
+type streamRun struct {
+	id  string
+	key string
+
+	mu         sync.Mutex
+	events     []streamEvent
+	finishedAt time.Time
+	changed    chan struct{}
+}
+
+func (r *streamRun) emit(event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[server] marshal stream event failed stream_id=%s event=%s err=%v", r.id, event, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, streamEvent{seq: len(r.events) + 1, event: event, data: payload})
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *streamRun) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finishedAt = time.Now()
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// after returns the events following seq, whether the run has finished, and a
+// channel closed on the next change.
+func (r *streamRun) after(seq int) ([]streamEvent, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq > len(r.events) {
+		seq = len(r.events)
+	}
+
+	return r.events[seq:], !r.finishedAt.IsZero(), r.changed
+}
+
+type streamStore struct {
+	retention time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*streamRun
+}
+
+func newStreamStore(retention time.Duration) *streamStore {
+	return &streamStore{retention: retention, runs: make(map[string]*streamRun)}
+}
+
+func (st *streamStore) start(key string) (*streamRun, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("generate stream id: %w", err)
+	}
+	run := &streamRun{id: base64.RawURLEncoding.EncodeToString(raw), key: key, changed: make(chan struct{})}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, r := range st.runs {
+		r.mu.Lock()
+		expired := !r.finishedAt.IsZero() && time.Since(r.finishedAt) > st.retention
+		r.mu.Unlock()
+		if expired {
+			delete(st.runs, id)
+		}
+	}
+	st.runs[run.id] = run
+
+	return run, nil
+}
+
+func (st *streamStore) get(id string) (*streamRun, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	run, ok := st.runs[id]
+	return run, ok
+}
+
+// parseStreamEventID splits an event id of the form "<stream id>:<seq>".
+func parseStreamEventID(id string) (string, int, error) {
+	i := strings.LastIndexByte(id, ':')
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid event id %q", id)
+	}
+	seq, err := strconv.Atoi(id[i+1:])
+	if err != nil || seq < 0 {
+		return "", 0, fmt.Errorf("invalid event id %q", id)
+	}
+
+	return id[:i], seq, nil
+}
+
+func (s *Server) handleDeviceAction(c *gin.Context) {
+	switch c.Param("action") {
+	case "messages":
+		s.handleDeviceMessage(c)
+	case "messages:stream":
+		s.handleDeviceMessageStream(c)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"code": "NOT_FOUND", "error": "unknown device action"})
+	}
+}
+
+// handleDeviceMessageStream runs one message and streams its progress, stdout
+// chunks and final result as server-sent events. The run outlives the request,
+// so a request carrying Last-Event-ID resumes it instead of starting another.
+func (s *Server) handleDeviceMessageStream(c *gin.Context) {
+	deviceID := c.Param("deviceId")
+	claims, ok := s.admitDevice(c, deviceID, auth.ScopeChat)
+	if !ok {
+		return
+	}
+
+	var run *streamRun
+	after := 0
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		streamID, seq, err := parseStreamEventID(lastEventID)
+		if err == nil {
+			run, ok = s.streams.get(streamID)
+		}
+		if err != nil || !ok || run.key != sessionID(claims, deviceID) {
+			log.Printf("[server] reject stream resume: unknown stream session_id=%s last_event_id=%q", deviceID, lastEventID)
+			c.JSON(http.StatusNotFound, gin.H{"code": "STREAM_NOT_FOUND", "error": "stream is unknown or expired"})
+			return
+		}
+		after = seq
+		log.Printf("[server] resuming stream session_id=%s stream_id=%s after=%d", deviceID, run.id, after)
+	} else {
+		req, ok := bindMessageRequest(c)
+		if !ok {
+			return
+		}
+		if req.CallbackURL != "" {
+			if err := s.checkCallbackURL(claims, req.CallbackURL); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"code": "INVALID_REQUEST", "error": err.Error()})
+				return
+			}
+		}
+		if _, err := s.optionArgs(claims, req.Options); err != nil {
+			writeMessageError(c, err)
+			return
+		}
+		if _, err := s.runTimeout(claims, sessionID(claims, deviceID), req.TimeoutSeconds); err != nil {
+			writeMessageError(c, err)
+			return
+		}
+
+		var err error
+		if run, err = s.streams.start(sessionID(claims, deviceID)); err != nil {
+			log.Printf("[server] start stream failed session_id=%s err=%v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": "INTERNAL_ERROR", "error": "failed to start stream"})
+			return
+		}
+		log.Printf("[server] received stream message session_id=%s stream_id=%s message_len=%d", deviceID, run.id, len(req.Message))
+		go s.runStream(context.WithoutCancel(c.Request.Context()), run, claims, deviceID, req)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	s.followStream(c, run, after)
+}
+
+func (s *Server) runStream(ctx context.Context, run *streamRun, claims *auth.Claims, deviceID string, req messageRequest) {
+	defer run.finish()
+
+	opts := req.runOptions()
+	opts.progress = func(status string) {
+		run.emit(sseEventProgress, gin.H{"status": status})
+	}
+	// Chunks are cut anywhere, so a character split between two of them is
+	// held back until the rest arrives instead of being mangled into U+FFFD.
+	var pending []byte
+	opts.output = func(chunk []byte) {
+		pending = append(pending, chunk...)
+		n := wholeRunes(pending)
+		if n == 0 {
+			return
+		}
+		run.emit(sseEventChunk, gin.H{"text": string(pending[:n])})
+		pending = append([]byte(nil), pending[n:]...)
+	}
+	jsonPayload, err := s.runMessage(ctx, claims, deviceID, req.Message, opts)
+	if len(pending) > 0 {
+		run.emit(sseEventChunk, gin.H{"text": string(pending)})
+	}
+	if err != nil {
+		msgErr := asMessageError(err)
+		body := gin.H{"code": msgErr.Code, "error": msgErr.Message}
+		if !msgErr.ResetAt.IsZero() {
+			body["resetAt"] = msgErr.ResetAt.Unix()
+		}
+		if msgErr.Output != "" {
+			body["output"] = msgErr.Output
+		}
+		run.emit(sseEventError, body)
+		return
+	}
+
+	run.emit(sseEventResult, json.RawMessage(jsonPayload))
+}
+
+// wholeRunes returns the length of p without an incomplete UTF-8 sequence at
+// its end.
+func wholeRunes(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return i
+			}
+			break
+		}
+	}
+
+	return len(p)
+}
+
+// followStream writes the run's events after seq until the run finishes or the
+// client goes away.
+func (s *Server) followStream(c *gin.Context, run *streamRun, seq int) {
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		events, done, changed := run.after(seq)
+		for _, ev := range events {
+			if _, err := fmt.Fprintf(c.Writer, "id: %s:%d\nevent: %s\ndata: %s\n\n", run.id, ev.seq, ev.event, ev.data); err != nil {
+				log.Printf("[server] write stream event failed stream_id=%s err=%v", run.id, err)
+				return
+			}
+			seq = ev.seq
+		}
+		c.Writer.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			log.Printf("[server] stream client gone stream_id=%s seq=%d", run.id, seq)
+			return
+		}
+	}
+}
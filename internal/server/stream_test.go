@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type streamingExecutor struct {
+	chunks []string
+	calls  atomic.Int32
+}
+
+func (e *streamingExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e *streamingExecutor) RunStream(_ context.Context, _, _ string, onOutput func([]byte)) (string, error) {
+	e.calls.Add(1)
+	for _, chunk := range e.chunks {
+		if onOutput != nil {
+			onOutput([]byte(chunk))
+		}
+	}
+	return strings.Join(e.chunks, ""), nil
+}
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func readSSE(t *testing.T, r io.Reader) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.event != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read event stream: %v", err)
+	}
+
+	return events
+}
+
+func postStream(t *testing.T, baseURL, lastEventID, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/devices/device-1/messages:stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("build stream request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+mustCreateToken(t))
+	req.Header.Set("Content-Type", "application/json")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post stream request: %v", err)
+	}
+
+	return resp
+}
+
+func TestDeviceMessageStream_EmitsProgressChunksAndResult(t *testing.T) {
+	exec := &streamingExecutor{chunks: []string{"working\n", "{\"result\":\n\"ok\"}"}}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	resp := postStream(t, ts.URL, "", `{"message":"hello"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response status=%d content-type=%q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := readSSE(t, resp.Body)
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.event)
+	}
+	if got := strings.Join(names, ","); got != "progress,progress,chunk,chunk,result" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+	if last := events[len(events)-1]; last.data != `{"result":"ok"}` {
+		t.Fatalf("unexpected result data: %s", last.data)
+	}
+}
+
+func TestDeviceMessageStream_KeepsCharactersSplitAcrossChunks(t *testing.T) {
+	reply := "{\"reply\":\"你好\"}"
+	split := strings.Index(reply, "你") + 1
+	exec := &streamingExecutor{chunks: []string{reply[:split], reply[split:]}}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	resp := postStream(t, ts.URL, "", `{"message":"hello"}`)
+	defer resp.Body.Close()
+	var text strings.Builder
+	for _, ev := range readSSE(t, resp.Body) {
+		if ev.event != sseEventChunk {
+			continue
+		}
+		var chunk struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte(ev.data), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", ev.data, err)
+		}
+		text.WriteString(chunk.Text)
+	}
+	if text.String() != reply {
+		t.Fatalf("expected the chunks to add up to %q, got %q", reply, text.String())
+	}
+}
+
+func TestDeviceMessageStream_TimeoutErrorCarriesPartialOutput(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, partialExecutor{})
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	resp := postStream(t, ts.URL, "", `{"message":"hello","timeoutSeconds":1}`)
+	defer resp.Body.Close()
+	events := readSSE(t, resp.Body)
+	last := events[len(events)-1]
+	var body struct {
+		Code   string `json:"code"`
+		Output string `json:"output"`
+	}
+	if err := json.Unmarshal([]byte(last.data), &body); err != nil {
+		t.Fatalf("decode error event %q: %v", last.data, err)
+	}
+	if last.event != sseEventError || body.Code != "TIMEOUT" || body.Output != "thinking..." {
+		t.Fatalf("expected a TIMEOUT error event with partial output, got %+v", last)
+	}
+}
+
+func TestDeviceMessageStream_ResumesFromLastEventID(t *testing.T) {
+	exec := &streamingExecutor{chunks: []string{"a", "b", `{"result":"ok"}`}}
+	srv := NewWithExecutor(":0", testJWTSecret, exec)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	resp := postStream(t, ts.URL, "", `{"message":"hello"}`)
+	first := readSSE(t, resp.Body)
+	resp.Body.Close()
+
+	resp = postStream(t, ts.URL, first[2].id, "")
+	defer resp.Body.Close()
+	resumed := readSSE(t, resp.Body)
+
+	if len(resumed) != len(first)-3 {
+		t.Fatalf("expected %d resumed events, got %d", len(first)-3, len(resumed))
+	}
+	for i, ev := range resumed {
+		if ev != first[i+3] {
+			t.Fatalf("resumed event %d = %+v, want %+v", i, ev, first[i+3])
+		}
+	}
+	if calls := exec.calls.Load(); calls != 1 {
+		t.Fatalf("expected resume to reuse the stored run, executor ran %d times", calls)
+	}
+}
+
+func TestDeviceMessageStream_UnknownLastEventID(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &streamingExecutor{})
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	resp := postStream(t, ts.URL, "missing:1", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
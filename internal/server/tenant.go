@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+
+	"clawproxy/internal/auth"
+	"clawproxy/internal/ratelimit"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantConfig isolates one team sharing the proxy: tokens carrying its id in
+// the tenant claim are verified with its secrets, limited by its limits and
+// run through its openclaw profile.
+type TenantConfig struct {
+	ID string `json:"id"`
+	// Secrets verify tenant tokens; list several to rotate keys.
+	Secrets  []string         `json:"secrets"`
+	Limits   ratelimit.Limits `json:"limits,omitempty"`
+	OpenClaw OpenClawExecutor `json:"openclaw,omitempty"`
+	// Command replaces the openclaw profile with a command template.
+	Command  *TemplateExecutor `json:"command,omitempty"`
+	Webhooks WebhookConfig     `json:"webhooks,omitempty"`
+	// Options replaces the server's option allowlist for this tenant.
+	Options map[string]OptionRule `json:"options,omitempty"`
+}
+
+func (t TenantConfig) Validate() error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("invalid tenant id %q: use lowercase letters, digits, '-' and '_'", t.ID)
+	}
+	if len(t.Secrets) == 0 {
+		return fmt.Errorf("tenant %s: at least one secret is required", t.ID)
+	}
+	for _, secret := range t.Secrets {
+		if secret == "" {
+			return fmt.Errorf("tenant %s: empty secret", t.ID)
+		}
+	}
+	for name, rule := range t.Options {
+		if err := rule.Validate(name); err != nil {
+			return fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+	}
+
+	return nil
+}
+
+type tenant struct {
+	cfg      TenantConfig
+	secrets  [][]byte
+	executor CommandExecutor
+}
+
+func newTenant(cfg TenantConfig) *tenant {
+	t := &tenant{cfg: cfg, executor: cfg.OpenClaw}
+	if cfg.Command != nil {
+		t.executor = *cfg.Command
+	}
+	for _, secret := range cfg.Secrets {
+		t.secrets = append(t.secrets, []byte(secret))
+	}
+
+	return t
+}
+
+// tokenKeys selects the signing secrets by the token's tenant claim.
+func (s *Server) tokenKeys(unverified *auth.Claims) ([][]byte, error) {
+	if unverified.Tenant == "" {
+		return [][]byte{s.jwtSecret}, nil
+	}
+
+	t, ok := s.tenants[unverified.Tenant]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %q", unverified.Tenant)
+	}
+
+	return t.secrets, nil
+}
+
+// sessionID is the id passed to openclaw and used for per-device state. Devices
+// of named tenants are prefixed so equal deviceIds in two tenants never collide;
+// the default tenant keeps bare deviceIds, which authorize keeps free of colons.
+func sessionID(claims *auth.Claims, deviceID string) string {
+	if claims.Tenant == "" {
+		return deviceID
+	}
+
+	return claims.Tenant + ":" + deviceID
+}
+
+func (s *Server) executorFor(claims *auth.Claims) CommandExecutor {
+	if t, ok := s.tenants[claims.Tenant]; ok && claims.Tenant != "" {
+		return t.executor
+	}
+
+	return s.executor
+}
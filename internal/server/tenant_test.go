@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"clawproxy/internal/auth"
+	"github.com/gorilla/websocket"
+)
+
+func mustCreateTenantToken(t *testing.T, secret, tenant, subject string, scopes ...string) string {
+	t.Helper()
+	token, err := auth.SignToken([]byte(secret), auth.Claims{Subject: subject, Tenant: tenant, Scope: strings.Join(scopes, " ")})
+	if err != nil {
+		t.Fatalf("sign tenant token: %v", err)
+	}
+
+	return token
+}
+
+func newTenantServer(t *testing.T) (*Server, *fakeExecutor) {
+	t.Helper()
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{},
+		WithTenants(TenantConfig{ID: "team-a", Secrets: []string{"team-a-old", "team-a-new"}}))
+	tenantExec := &fakeExecutor{output: `{"result":"ok"}`}
+	srv.tenants["team-a"].executor = tenantExec
+
+	return srv, tenantExec
+}
+
+func TestHandleWS_TenantSessionIsNamespaced(t *testing.T) {
+	srv, tenantExec := newTenantServer(t)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	conn := dialWS(t, wsURL, mustCreateTenantToken(t, "team-a-new", "team-a", "device-1"))
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read websocket message: %v", err)
+	}
+	if tenantExec.gotDeviceID != "team-a:device-1" {
+		t.Fatalf("expected tenant session id, got %q", tenantExec.gotDeviceID)
+	}
+}
+
+func TestHandleWS_TenantTokenRequiresTenantSecret(t *testing.T) {
+	srv, _ := newTenantServer(t)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?deviceId=device-1"
+	for name, token := range map[string]string{
+		"default secret": mustCreateTenantToken(t, testJWTSecret, "team-a", "device-1"),
+		"unknown tenant": mustCreateTenantToken(t, "team-a-new", "team-b", "device-1"),
+	} {
+		header := http.Header{}
+		header.Set("Authorization", token)
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			t.Fatalf("%s: expected handshake to fail", name)
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: expected status %d, got %+v", name, http.StatusUnauthorized, resp)
+		}
+	}
+}
+
+func TestAdminRoutes_RejectTenantAdmin(t *testing.T) {
+	srv, _ := newTenantServer(t)
+	r := srv.Engine()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/pairings", nil)
+	req.Header.Set("Authorization", mustCreateTenantToken(t, "team-a-old", "team-a", "ops", auth.ScopeAdmin))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestTenantConfig_Validate(t *testing.T) {
+	if err := (TenantConfig{ID: "Team A", Secrets: []string{"s"}}).Validate(); err == nil {
+		t.Fatal("expected invalid tenant id to be rejected")
+	}
+	if err := (TenantConfig{ID: "team-a"}).Validate(); err == nil {
+		t.Fatal("expected tenant without secrets to be rejected")
+	}
+}
+
+func TestDefaultTenantCannotReachTenantSession(t *testing.T) {
+	srv, tenantExec := newTenantServer(t)
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	if _, err := auth.SignToken([]byte(testJWTSecret), auth.Claims{Subject: "team-a:device-1"}); err == nil {
+		t.Fatal("expected a default-tenant token for a tenant session id to be refused")
+	}
+
+	admin := mustCreateTenantToken(t, testJWTSecret, "", "ops", auth.ScopeAdmin, auth.ScopeChat)
+	header := http.Header{}
+	header.Set("Authorization", admin)
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?deviceId=team-a:device-1", header)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %+v", http.StatusBadRequest, resp)
+	}
+	if tenantExec.gotDeviceID != "" {
+		t.Fatalf("tenant executor reached with %q", tenantExec.gotDeviceID)
+	}
+
+	tenantSession := sessionID(&auth.Claims{Subject: "device-1", Tenant: "team-a"}, "device-1")
+	if auth.ValidateDeviceID("", tenantSession) == nil {
+		t.Fatalf("tenant session %q is also a valid default deviceId", tenantSession)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+const wsTicketTTL = 30 * time.Second
+
+type ticketEntry struct {
+	claims    *auth.Claims
+	expiresAt time.Time
+}
+
+// ticketStore keeps short-lived, single-use tickets that stand in for a JWT on
+// the /ws handshake, for clients that cannot set request headers.
+type ticketStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	tickets map[string]ticketEntry
+}
+
+func newTicketStore(ttl time.Duration) *ticketStore {
+	return &ticketStore{ttl: ttl, tickets: make(map[string]ticketEntry)}
+}
+
+func (ts *ticketStore) issue(claims *auth.Claims) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, fmt.Errorf("generate ticket: %w", err)
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	expiresAt := now.Add(ts.ttl)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for key, entry := range ts.tickets {
+		if !entry.expiresAt.After(now) {
+			delete(ts.tickets, key)
+		}
+	}
+	ts.tickets[ticket] = ticketEntry{claims: claims, expiresAt: expiresAt}
+
+	return ticket, expiresAt, nil
+}
+
+// redeem consumes the ticket. A ticket can be redeemed at most once.
+func (ts *ticketStore) redeem(ticket string) (*auth.Claims, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	entry, ok := ts.tickets[ticket]
+	if !ok {
+		return nil, false
+	}
+	delete(ts.tickets, ticket)
+
+	if !entry.expiresAt.After(time.Now()) {
+		return nil, false
+	}
+
+	return entry.claims, true
+}
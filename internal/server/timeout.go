@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+const (
+	defaultExecutorTimeout = 5 * time.Minute
+	defaultKillGrace       = 5 * time.Second
+)
+
+// TimeoutConfig bounds how long a message may run. Zero values use the
+// defaults: five minutes to run and five seconds between SIGTERM and SIGKILL.
+type TimeoutConfig struct {
+	DefaultSeconds int `json:"defaultSeconds,omitempty"`
+	// Devices overrides the default per session id.
+	Devices map[string]int `json:"devices,omitempty"`
+	// MaxSeconds caps the timeoutSeconds a request may ask for, per scope.
+	// Tokens get the largest cap among their scopes; without one, requests
+	// can only shorten their timeout.
+	MaxSeconds map[string]int `json:"maxSeconds,omitempty"`
+	// GraceSeconds is how long a timed-out command has to exit after SIGTERM
+	// before its process group is killed.
+	GraceSeconds int `json:"graceSeconds,omitempty"`
+}
+
+// Override returns c with every non-zero field of o applied on top.
+func (c TimeoutConfig) Override(o TimeoutConfig) TimeoutConfig {
+	if o.DefaultSeconds > 0 {
+		c.DefaultSeconds = o.DefaultSeconds
+	}
+	if o.Devices != nil {
+		c.Devices = o.Devices
+	}
+	if o.MaxSeconds != nil {
+		c.MaxSeconds = o.MaxSeconds
+	}
+	if o.GraceSeconds > 0 {
+		c.GraceSeconds = o.GraceSeconds
+	}
+
+	return c
+}
+
+func (c TimeoutConfig) Validate() error {
+	if c.DefaultSeconds < 0 || c.GraceSeconds < 0 {
+		return fmt.Errorf("timeouts: seconds must not be negative")
+	}
+	for device, seconds := range c.Devices {
+		if seconds <= 0 {
+			return fmt.Errorf("timeouts: device %s: seconds must be positive", device)
+		}
+	}
+	for scope, seconds := range c.MaxSeconds {
+		if err := auth.ValidateScopes([]string{scope}); err != nil {
+			return fmt.Errorf("timeouts: %w", err)
+		}
+		if seconds <= 0 {
+			return fmt.Errorf("timeouts: scope %s: seconds must be positive", scope)
+		}
+	}
+
+	return nil
+}
+
+func (c TimeoutConfig) grace() time.Duration {
+	if c.GraceSeconds > 0 {
+		return time.Duration(c.GraceSeconds) * time.Second
+	}
+
+	return defaultKillGrace
+}
+
+// WithTimeouts configures message timeouts.
+func WithTimeouts(cfg TimeoutConfig) Option {
+	return func(s *Server) {
+		s.timeouts = cfg
+	}
+}
+
+// deviceTimeout is the configured timeout of a session id.
+func (s *Server) deviceTimeout(key string) time.Duration {
+	if device, ok := s.timeouts.Devices[key]; ok {
+		return time.Duration(device) * time.Second
+	}
+	if s.timeouts.DefaultSeconds > 0 {
+		return time.Duration(s.timeouts.DefaultSeconds) * time.Second
+	}
+
+	return defaultExecutorTimeout
+}
+
+// runTimeout resolves the timeout of one message: the device's default, or
+// the requested seconds when the token's scopes allow that many.
+func (s *Server) runTimeout(claims *auth.Claims, key string, requestedSeconds int) (time.Duration, error) {
+	seconds := int(s.deviceTimeout(key) / time.Second)
+	if requestedSeconds == 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	max := seconds
+	for scope, scopeMax := range s.timeouts.MaxSeconds {
+		if claims.HasScope(scope) && scopeMax > max {
+			max = scopeMax
+		}
+	}
+	if requestedSeconds < 0 || requestedSeconds > max {
+		return 0, &messageError{Status: http.StatusBadRequest, Code: "INVALID_TIMEOUT", Message: fmt.Sprintf("timeoutSeconds must be between 1 and %d", max)}
+	}
+
+	return time.Duration(requestedSeconds) * time.Second, nil
+}
+
+type killGraceKey struct{}
+
+func withKillGrace(ctx context.Context, grace time.Duration) context.Context {
+	return context.WithValue(ctx, killGraceKey{}, grace)
+}
+
+// killGraceFrom returns how long a canceled command may take to exit after
+// SIGTERM.
+func killGraceFrom(ctx context.Context) time.Duration {
+	if grace, ok := ctx.Value(killGraceKey{}).(time.Duration); ok {
+		return grace
+	}
+
+	return defaultKillGrace
+}
+
+type shortenedTimeoutKey struct{}
+
+// withShortenedTimeout marks ctx's deadline as one the client asked for below
+// the configured timeout, so running past it says nothing about the executor.
+func withShortenedTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shortenedTimeoutKey{}, true)
+}
+
+func shortenedTimeout(ctx context.Context) bool {
+	shortened, _ := ctx.Value(shortenedTimeoutKey{}).(bool)
+	return shortened
+}
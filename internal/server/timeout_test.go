@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clawproxy/internal/auth"
+)
+
+func TestRunTimeout(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{}, WithTimeouts(TimeoutConfig{
+		DefaultSeconds: 60,
+		Devices:        map[string]int{"slow-device": 900},
+		MaxSeconds:     map[string]int{auth.ScopeChat: 120, auth.ScopeAdmin: 3600},
+	}))
+	chat := &auth.Claims{Subject: "device-1"}
+	admin := &auth.Claims{Subject: "device-1", Scope: auth.ScopeAdmin}
+
+	tests := []struct {
+		name      string
+		claims    *auth.Claims
+		key       string
+		requested int
+		want      time.Duration
+		wantErr   bool
+	}{
+		{name: "default", claims: chat, key: "device-1", want: time.Minute},
+		{name: "device default", claims: chat, key: "slow-device", want: 15 * time.Minute},
+		{name: "shorter", claims: chat, key: "device-1", requested: 5, want: 5 * time.Second},
+		{name: "scope max", claims: chat, key: "device-1", requested: 120, want: 2 * time.Minute},
+		{name: "above scope max", claims: chat, key: "device-1", requested: 121, wantErr: true},
+		{name: "admin max", claims: admin, key: "device-1", requested: 3600, want: time.Hour},
+		{name: "negative", claims: chat, key: "device-1", requested: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := srv.runTimeout(tt.claims, tt.key, tt.requested)
+		if tt.wantErr {
+			if code := asMessageError(err).Code; err == nil || code != "INVALID_TIMEOUT" {
+				t.Fatalf("%s: expected INVALID_TIMEOUT, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Fatalf("%s: expected %s, got %s err=%v", tt.name, tt.want, got, err)
+		}
+	}
+}
+
+// partialExecutor prints some output, then hangs until its context ends.
+type partialExecutor struct{}
+
+func (partialExecutor) Run(ctx context.Context, _, _ string) (string, error) {
+	<-ctx.Done()
+	return "thinking...", ctx.Err()
+}
+
+func TestHandleWS_TimeoutFrameWithPartialOutput(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, partialExecutor{})
+	ts := httptest.NewServer(srv.Engine())
+	defer ts.Close()
+
+	conn := dialWS(t, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?deviceId=device-1", mustCreateToken(t))
+	defer conn.Close()
+
+	if err := conn.WriteJSON(wsRequest{Message: "hello", TimeoutSeconds: 1}); err != nil {
+		t.Fatalf("write websocket message: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame wsError
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("read websocket frame: %v", err)
+	}
+	if frame.Code != "TIMEOUT" || frame.Output != "thinking..." {
+		t.Fatalf("expected TIMEOUT frame with partial output, got %+v", frame)
+	}
+}
+
+func TestDeviceMessage_TimeoutAboveMax(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{}`})
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", TimeoutSeconds: 3600})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	if code := decodeErrorCode(t, w.Body.Bytes()); code != "INVALID_TIMEOUT" {
+		t.Fatalf("expected code INVALID_TIMEOUT, got %s", code)
+	}
+}
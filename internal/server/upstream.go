@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoutingRoundRobin = "round-robin"
+	RoutingHash       = "hash"
+)
+
+// hashReplicas is how many points each upstream gets on the hash ring, so
+// adding or removing one moves only its share of sessions.
+const hashReplicas = 128
+
+// maxUpstreamErrorBody bounds how much of an error response is logged.
+const maxUpstreamErrorBody = 4 << 10
+
+// HTTPExecutorConfig forwards messages to remote openclaw gateways. Each
+// message is POSTed as {"sessionId","message","args","tenant","subject"} and
+// the response body is the agent's output.
+type HTTPExecutorConfig struct {
+	Upstreams []string `json:"upstreams"`
+	// Routing is round-robin (default) or hash, which keeps every session on
+	// one upstream via consistent hashing of its session id.
+	Routing string `json:"routing,omitempty"`
+	// Headers are sent with every request; values may reference environment
+	// variables, e.g. "Bearer ${OPENCLAW_TOKEN}".
+	Headers        map[string]string `json:"headers,omitempty"`
+	TimeoutSeconds int               `json:"timeoutSeconds,omitempty"`
+	TLS            UpstreamTLS       `json:"tls,omitempty"`
+}
+
+type UpstreamTLS struct {
+	// CA verifies the upstreams instead of the system roots.
+	CA string `json:"ca,omitempty"`
+	// Cert and Key present a client certificate.
+	Cert               string `json:"cert,omitempty"`
+	Key                string `json:"key,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+func (c HTTPExecutorConfig) Validate() error {
+	if len(c.Upstreams) == 0 {
+		return fmt.Errorf("http executor: at least one upstream is required")
+	}
+	for _, raw := range c.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http executor: invalid upstream %q", raw)
+		}
+	}
+	switch c.Routing {
+	case "", RoutingRoundRobin, RoutingHash:
+	default:
+		return fmt.Errorf("http executor: unknown routing %q", c.Routing)
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("http executor: timeoutSeconds must not be negative")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("http executor: tls cert and key must be set together")
+	}
+
+	return nil
+}
+
+func (t UpstreamTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CA != "" {
+		caPEM, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("upstream ca %s contains no certificates", t.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// HTTPExecutor is the CommandExecutor for HTTPExecutorConfig.
+type HTTPExecutor struct {
+	cfg    HTTPExecutorConfig
+	client *http.Client
+	next   atomic.Uint64
+	ring   []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream string
+}
+
+func NewHTTPExecutor(cfg HTTPExecutorConfig) (*HTTPExecutor, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLS.config()
+	if err != nil {
+		return nil, fmt.Errorf("http executor: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	e := &HTTPExecutor{cfg: cfg, client: &http.Client{Transport: transport, Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}}
+	if cfg.Routing == RoutingHash {
+		for _, upstream := range cfg.Upstreams {
+			for i := 0; i < hashReplicas; i++ {
+				e.ring = append(e.ring, ringPoint{hash: hashKey(upstream + "#" + strconv.Itoa(i)), upstream: upstream})
+			}
+		}
+		sort.Slice(e.ring, func(i, j int) bool { return e.ring[i].hash < e.ring[j].hash })
+	}
+
+	return e, nil
+}
+
+func hashKey(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// upstream picks the upstream for a session.
+func (e *HTTPExecutor) upstream(sessionID string) string {
+	if e.ring == nil {
+		n := e.next.Add(1) - 1
+		return e.cfg.Upstreams[n%uint64(len(e.cfg.Upstreams))]
+	}
+
+	h := hashKey(sessionID)
+	i := sort.Search(len(e.ring), func(i int) bool { return e.ring[i].hash >= h })
+	if i == len(e.ring) {
+		i = 0
+	}
+
+	return e.ring[i].upstream
+}
+
+type upstreamRequest struct {
+	SessionID string   `json:"sessionId"`
+	Message   string   `json:"message"`
+	Args      []string `json:"args,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+}
+
+func (e *HTTPExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+// RunStream forwards the message and streams the response body to onOutput.
+// Upstream failures come back as messageErrors with proxy error codes.
+func (e *HTTPExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	upstream := e.upstream(deviceID)
+	log.Printf("[executor] start upstream request session_id=%s upstream=%s", deviceID, upstream)
+
+	body := upstreamRequest{SessionID: deviceID, Message: message, Args: optionArgsFrom(ctx)}
+	if claims := callerClaims(ctx); claims != nil {
+		body.Tenant = claims.Tenant
+		body.Subject = claims.Subject
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("encode upstream request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("build upstream request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.cfg.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("[executor] upstream request failed session_id=%s upstream=%s err=%v", deviceID, upstream, err)
+		return "", upstreamError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+		log.Printf("[executor] upstream returned error session_id=%s upstream=%s status=%d body=%q", deviceID, upstream, resp.StatusCode, errBody)
+		return "", upstreamStatusError(resp)
+	}
+
+	var output bytes.Buffer
+	var dst io.Writer = &output
+	if onOutput != nil {
+		dst = io.MultiWriter(&output, outputFunc(onOutput))
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		log.Printf("[executor] read upstream response failed session_id=%s upstream=%s err=%v", deviceID, upstream, err)
+		return output.String(), upstreamError(ctx, err)
+	}
+
+	log.Printf("[executor] upstream request finished session_id=%s upstream=%s output_bytes=%d", deviceID, upstream, output.Len())
+	return output.String(), nil
+}
+
+// upstreamError maps a transport failure. Cancellation of ctx is left to the
+// caller, which reports it like any other executor.
+func upstreamError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &messageError{Status: http.StatusGatewayTimeout, Code: "TIMEOUT", Message: "agent did not respond in time", Err: err}
+	}
+
+	return &messageError{Status: http.StatusServiceUnavailable, Code: "UPSTREAM_UNAVAILABLE", Message: "agent upstream is unavailable", Err: err}
+}
+
+func upstreamStatusError(resp *http.Response) error {
+	err := fmt.Errorf("upstream status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		msgErr := &messageError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED", Message: "agent upstream is rate limited", Err: err}
+		if seconds, convErr := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); convErr == nil && seconds > 0 {
+			msgErr.ResetAt = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		return msgErr
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusGatewayTimeout:
+		return &messageError{Status: http.StatusGatewayTimeout, Code: "TIMEOUT", Message: "agent did not respond in time", Err: err}
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable:
+		return &messageError{Status: http.StatusServiceUnavailable, Code: "UPSTREAM_UNAVAILABLE", Message: "agent upstream is unavailable", Err: err}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &messageError{Status: http.StatusBadGateway, Code: "UPSTREAM_AUTH_FAILED", Message: "agent upstream rejected the proxy's credentials", Err: err}
+	default:
+		return &messageError{Status: http.StatusBadGateway, Code: "EXECUTOR_FAILED", Message: "agent command failed", Err: err}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func upstreamServer(t *testing.T, name string, handle func(w http.ResponseWriter, r *http.Request, req upstreamRequest)) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req upstreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if handle != nil {
+			handle(w, r, req)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"upstream": name, "session": req.SessionID})
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func upstreamOf(t *testing.T, e *HTTPExecutor, sessionID string) string {
+	t.Helper()
+	out, err := e.Run(context.Background(), sessionID, "hello")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var reply map[string]string
+	if err := json.Unmarshal([]byte(out), &reply); err != nil {
+		t.Fatalf("decode %q: %v", out, err)
+	}
+
+	return reply["upstream"]
+}
+
+func TestHTTPExecutor_RoundRobin(t *testing.T) {
+	a, b := upstreamServer(t, "a", nil), upstreamServer(t, "b", nil)
+	e, err := NewHTTPExecutor(HTTPExecutorConfig{Upstreams: []string{a.URL, b.URL}})
+	if err != nil {
+		t.Fatalf("new executor: %v", err)
+	}
+
+	got := []string{upstreamOf(t, e, "dev-1"), upstreamOf(t, e, "dev-1"), upstreamOf(t, e, "dev-1")}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Fatalf("expected alternating upstreams, got %v", got)
+	}
+}
+
+func TestHTTPExecutor_HashSticksSessions(t *testing.T) {
+	a, b, c := upstreamServer(t, "a", nil), upstreamServer(t, "b", nil), upstreamServer(t, "c", nil)
+	e, err := NewHTTPExecutor(HTTPExecutorConfig{Upstreams: []string{a.URL, b.URL, c.URL}, Routing: RoutingHash})
+	if err != nil {
+		t.Fatalf("new executor: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, session := range []string{"dev-1", "dev-2", "dev-3", "dev-4", "dev-5", "dev-6", "dev-7", "dev-8"} {
+		first := upstreamOf(t, e, session)
+		for i := 0; i < 3; i++ {
+			if again := upstreamOf(t, e, session); again != first {
+				t.Fatalf("session %s moved from %s to %s", session, first, again)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected sessions to spread over upstreams, got %v", seen)
+	}
+}
+
+func TestHTTPExecutor_SendsHeadersAndRequest(t *testing.T) {
+	t.Setenv("UPSTREAM_TEST_TOKEN", "s3cret")
+	var gotAuth string
+	var got upstreamRequest
+	ts := upstreamServer(t, "a", func(w http.ResponseWriter, r *http.Request, req upstreamRequest) {
+		gotAuth = r.Header.Get("Authorization")
+		got = req
+		w.Write([]byte(`{"reply":"hi"}`))
+	})
+	e, err := NewHTTPExecutor(HTTPExecutorConfig{Upstreams: []string{ts.URL}, Headers: map[string]string{"Authorization": "Bearer ${UPSTREAM_TEST_TOKEN}"}})
+	if err != nil {
+		t.Fatalf("new executor: %v", err)
+	}
+
+	ctx := withOptionArgs(context.Background(), []string{"--model", "x"})
+	out, err := e.Run(ctx, "acme:dev-1", "hello")
+	if err != nil || out != `{"reply":"hi"}` {
+		t.Fatalf("unexpected result %q %v", out, err)
+	}
+	if gotAuth != "Bearer s3cret" {
+		t.Fatalf("expected expanded auth header, got %q", gotAuth)
+	}
+	if got.SessionID != "acme:dev-1" || got.Message != "hello" || len(got.Args) != 2 {
+		t.Fatalf("unexpected upstream request: %+v", got)
+	}
+}
+
+func TestHTTPExecutor_MapsUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{status: http.StatusTooManyRequests, code: "RATE_LIMITED"},
+		{status: http.StatusServiceUnavailable, code: "UPSTREAM_UNAVAILABLE"},
+		{status: http.StatusGatewayTimeout, code: "TIMEOUT"},
+		{status: http.StatusUnauthorized, code: "UPSTREAM_AUTH_FAILED"},
+		{status: http.StatusInternalServerError, code: "EXECUTOR_FAILED"},
+	}
+	for _, tt := range tests {
+		ts := upstreamServer(t, "a", func(w http.ResponseWriter, r *http.Request, req upstreamRequest) {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(tt.status)
+		})
+		e, err := NewHTTPExecutor(HTTPExecutorConfig{Upstreams: []string{ts.URL}})
+		if err != nil {
+			t.Fatalf("new executor: %v", err)
+		}
+		srv := NewWithExecutor(":0", testJWTSecret, e)
+
+		w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi"})
+		if code := decodeErrorCode(t, w.Body.Bytes()); code != tt.code {
+			t.Fatalf("upstream %d: expected code %s, got %s", tt.status, tt.code, code)
+		}
+		if tt.code == "RATE_LIMITED" && w.Header().Get("Retry-After") == "" {
+			t.Fatal("expected Retry-After to be passed on")
+		}
+	}
+
+	e, err := NewHTTPExecutor(HTTPExecutorConfig{Upstreams: []string{"http://127.0.0.1:1"}})
+	if err != nil {
+		t.Fatalf("new executor: %v", err)
+	}
+	if _, err := e.Run(context.Background(), "dev-1", "hi"); asMessageError(err).Code != "UPSTREAM_UNAVAILABLE" {
+		t.Fatalf("expected UPSTREAM_UNAVAILABLE for a refused connection, got %v", err)
+	}
+}
+
+func TestHTTPExecutor_TLSCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+
+	if _, err := mustHTTPExecutor(t, HTTPExecutorConfig{Upstreams: []string{ts.URL}}).Run(context.Background(), "dev-1", "hi"); err == nil {
+		t.Fatal("expected an unknown CA to be rejected")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	out, err := mustHTTPExecutor(t, HTTPExecutorConfig{Upstreams: []string{ts.URL}, TLS: UpstreamTLS{CA: caFile}}).Run(context.Background(), "dev-1", "hi")
+	if err != nil || out != `{"ok":true}` {
+		t.Fatalf("expected the configured CA to be trusted, got %q %v", out, err)
+	}
+}
+
+func mustHTTPExecutor(t *testing.T, cfg HTTPExecutorConfig) *HTTPExecutor {
+	t.Helper()
+	e, err := NewHTTPExecutor(cfg)
+	if err != nil {
+		t.Fatalf("new executor: %v", err)
+	}
+
+	return e
+}
+
+func TestHTTPExecutorConfigValidate(t *testing.T) {
+	for _, cfg := range []HTTPExecutorConfig{
+		{},
+		{Upstreams: []string{"ftp://example.com"}},
+		{Upstreams: []string{"http://example.com"}, Routing: "random"},
+		{Upstreams: []string{"http://example.com"}, TLS: UpstreamTLS{Cert: "client.pem"}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+}
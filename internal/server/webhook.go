@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"clawproxy/internal/auth"
+	"clawproxy/internal/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	webhookEventCompleted = "message.completed"
+	webhookEventFailed    = "message.failed"
+)
+
+// WebhookConfig sends message results to HTTP endpoints for one tenant.
+type WebhookConfig struct {
+	// Secret signs every delivery; webhooks are disabled without it.
+	Secret string `json:"secret,omitempty"`
+	// Devices maps a deviceId to the URL receiving all of its results.
+	Devices map[string]string `json:"devices,omitempty"`
+	// CallbackHosts lists the hosts a request's callbackUrl may use; without
+	// it callbackUrl is refused.
+	CallbackHosts []string `json:"callbackHosts,omitempty"`
+}
+
+// WithWebhooks configures result webhooks for tokens without a tenant.
+func WithWebhooks(cfg WebhookConfig) Option {
+	return func(s *Server) {
+		s.webhooks = cfg
+	}
+}
+
+type webhookError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+type webhookPayload struct {
+	Event      string          `json:"event"`
+	DeviceID   string          `json:"deviceId"`
+	Tenant     string          `json:"tenant,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      *webhookError   `json:"error,omitempty"`
+	FinishedAt int64           `json:"finishedAt"`
+}
+
+func (s *Server) webhookConfig(claims *auth.Claims) WebhookConfig {
+	if t, ok := s.tenants[claims.Tenant]; ok && claims.Tenant != "" {
+		return t.cfg.Webhooks
+	}
+
+	return s.webhooks
+}
+
+// checkCallbackURL validates a callbackUrl supplied with a message.
+func (s *Server) checkCallbackURL(claims *auth.Claims, raw string) error {
+	cfg := s.webhookConfig(claims)
+	if cfg.Secret == "" {
+		return errors.New("webhooks are not configured")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callbackUrl must be an absolute http or https url")
+	}
+	if len(cfg.CallbackHosts) == 0 {
+		return errors.New("callbackUrl is not enabled: no callbackHosts are configured")
+	}
+	for _, host := range cfg.CallbackHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("callbackUrl host %s is not allowed", u.Hostname())
+}
+
+// notifyResult queues the outcome of a run for the device's webhook and the
+// request's callbackUrl. Messages refused before running are not reported;
+// their callers get the error directly, or through notifyRefused.
+func (s *Server) notifyResult(claims *auth.Claims, deviceID, callbackURL, jsonPayload string, runErr error) {
+	cfg := s.webhookConfig(claims)
+	if cfg.Secret == "" {
+		return
+	}
+	targets := make([]string, 0, 2)
+	if deviceURL := cfg.Devices[deviceID]; deviceURL != "" {
+		targets = append(targets, deviceURL)
+	}
+	if callbackURL != "" && callbackURL != cfg.Devices[deviceID] {
+		targets = append(targets, callbackURL)
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := webhookPayload{Event: webhookEventCompleted, DeviceID: deviceID, Tenant: claims.Tenant, FinishedAt: time.Now().Unix()}
+	if runErr != nil {
+		msgErr := asMessageError(runErr)
+		if msgErr.Status < http.StatusInternalServerError {
+			return
+		}
+		payload.Event = webhookEventFailed
+		payload.Error = &webhookError{Code: msgErr.Code, Error: msgErr.Message}
+	} else {
+		payload.Result = json.RawMessage(jsonPayload)
+	}
+
+	s.enqueueWebhooks(cfg, deviceID, targets, payload)
+}
+
+// notifyRefused reports a message refused before running to its callbackUrl,
+// for requests that were already answered 202.
+func (s *Server) notifyRefused(claims *auth.Claims, deviceID, callbackURL string, runErr error) {
+	msgErr := asMessageError(runErr)
+	if msgErr.Status >= http.StatusInternalServerError {
+		return
+	}
+	cfg := s.webhookConfig(claims)
+	if cfg.Secret == "" {
+		return
+	}
+
+	payload := webhookPayload{
+		Event:      webhookEventFailed,
+		DeviceID:   deviceID,
+		Tenant:     claims.Tenant,
+		Error:      &webhookError{Code: msgErr.Code, Error: msgErr.Message},
+		FinishedAt: time.Now().Unix(),
+	}
+	s.enqueueWebhooks(cfg, deviceID, []string{callbackURL}, payload)
+}
+
+func (s *Server) enqueueWebhooks(cfg WebhookConfig, deviceID string, targets []string, payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[server] marshal webhook payload failed session_id=%s err=%v", deviceID, err)
+		return
+	}
+	for _, target := range targets {
+		delivery, err := s.deliveries.Enqueue(target, payload.Event, body, []byte(cfg.Secret))
+		if err != nil {
+			log.Printf("[server] enqueue webhook failed session_id=%s err=%v", deviceID, err)
+			continue
+		}
+		log.Printf("[server] webhook queued session_id=%s delivery_id=%s event=%s", deviceID, delivery.ID, payload.Event)
+	}
+}
+
+func (s *Server) handleListWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"deliveries": s.deliveries.List()})
+}
+
+func (s *Server) handleRetryWebhook(c *gin.Context) {
+	delivery, err := s.deliveries.Retry(c.Param("id"))
+	if errors.Is(err, webhook.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"code": "NOT_FOUND", "error": "dead letter not found"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+func (s *Server) handleDiscardWebhook(c *gin.Context) {
+	if err := s.deliveries.Discard(c.Param("id")); errors.Is(err, webhook.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"code": "NOT_FOUND", "error": "dead letter not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
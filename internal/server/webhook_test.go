@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"clawproxy/internal/ratelimit"
+	"clawproxy/internal/webhook"
+)
+
+type receivedWebhook struct {
+	payload webhookPayload
+	signed  bool
+}
+
+func startWebhookReceiver(t *testing.T, secret string, status int) (*httptest.Server, chan receivedWebhook) {
+	t.Helper()
+	received := make(chan receivedWebhook, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+		var payload webhookPayload
+		_ = json.Unmarshal(body, &payload)
+		received <- receivedWebhook{payload: payload, signed: r.Header.Get(webhook.HeaderSignature) == webhook.Sign([]byte(secret), timestamp, body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, received
+}
+
+func waitWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	t.Helper()
+	select {
+	case got := <-received:
+		return got
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not delivered")
+		return receivedWebhook{}
+	}
+}
+
+func TestDeviceMessage_CallbackURL(t *testing.T) {
+	receiver, received := startWebhookReceiver(t, "hook-secret", http.StatusOK)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{"result":"ok"}`}, WithWebhooks(WebhookConfig{Secret: "hook-secret", CallbackHosts: []string{"127.0.0.1"}}))
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", CallbackURL: receiver.URL})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d body=%s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	got := waitWebhook(t, received)
+	if !got.signed {
+		t.Fatal("expected webhook signed with the configured secret")
+	}
+	if got.payload.Event != webhookEventCompleted || got.payload.DeviceID != "device-1" || string(got.payload.Result) != `{"result":"ok"}` {
+		t.Fatalf("unexpected webhook payload: %+v", got.payload)
+	}
+}
+
+func TestDeviceMessage_DeviceWebhookReportsFailure(t *testing.T) {
+	receiver, received := startWebhookReceiver(t, "hook-secret", http.StatusOK)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: "no json"},
+		WithWebhooks(WebhookConfig{Secret: "hook-secret", Devices: map[string]string{"device-1": receiver.URL}}))
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi"})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+
+	got := waitWebhook(t, received)
+	if got.payload.Event != webhookEventFailed || got.payload.Error == nil || got.payload.Error.Code != "INVALID_OUTPUT" {
+		t.Fatalf("unexpected webhook payload: %+v", got.payload)
+	}
+}
+
+func TestDeviceMessage_CallbackURLRequiresWebhookSecret(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{})
+
+	w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", CallbackURL: "https://example.com/hook"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestDeviceMessage_CallbackURLRequiresCallbackHosts(t *testing.T) {
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{}, WithWebhooks(WebhookConfig{Secret: "hook-secret"}))
+
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest/meta-data"} {
+		w := doJSON(t, srv.Engine(), http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", CallbackURL: target})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", target, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestDeviceMessage_CallbackURLReportsRefusal(t *testing.T) {
+	receiver, received := startWebhookReceiver(t, "hook-secret", http.StatusOK)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{}`},
+		WithWebhooks(WebhookConfig{Secret: "hook-secret", CallbackHosts: []string{"127.0.0.1"}}),
+		WithLimits(ratelimit.Limits{PerMinute: 1, Burst: 1}))
+	r := srv.Engine()
+
+	if w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	w := doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", CallbackURL: receiver.URL})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	got := waitWebhook(t, received)
+	if got.payload.Event != webhookEventFailed || got.payload.Error == nil || got.payload.Error.Code != "RATE_LIMITED" {
+		t.Fatalf("unexpected webhook payload: %+v", got.payload)
+	}
+}
+
+func TestAdminWebhooks_DeadLetterRetry(t *testing.T) {
+	receiver, received := startWebhookReceiver(t, "hook-secret", http.StatusInternalServerError)
+	srv := NewWithExecutor(":0", testJWTSecret, &fakeExecutor{output: `{}`}, WithWebhooks(WebhookConfig{Secret: "hook-secret", CallbackHosts: []string{"127.0.0.1"}}))
+	srv.deliveries = webhook.NewDispatcher(webhook.Config{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Timeout: time.Second, MaxDeadLetters: 10})
+	r := srv.Engine()
+
+	doJSON(t, r, http.MethodPost, "/v1/devices/device-1/messages", mustCreateToken(t), messageRequest{Message: "hi", CallbackURL: receiver.URL})
+	waitWebhook(t, received)
+	waitWebhook(t, received)
+
+	var list struct {
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w := doJSON(t, r, http.MethodGet, "/v1/admin/webhooks", mustCreateAdminToken(t), nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("decode webhook list: %v", err)
+		}
+		if len(list.Deliveries) == 1 && list.Deliveries[0].Status == webhook.StatusDead {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one dead letter, got %+v", list.Deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := doJSON(t, r, http.MethodPost, "/v1/admin/webhooks/"+list.Deliveries[0].ID+"/retry", mustCreateAdminToken(t), nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	waitWebhook(t, received)
+}
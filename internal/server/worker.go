@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"clawproxy/internal/workerpool"
+)
+
+// WorkerExecutor runs messages on a pool of warm openclaw workers instead of
+// starting a process per message.
+type WorkerExecutor struct {
+	// Name labels the pool's metrics.
+	Name string
+	Pool *workerpool.Pool
+}
+
+func (e WorkerExecutor) Run(ctx context.Context, deviceID, message string) (string, error) {
+	return e.RunStream(ctx, deviceID, message, nil)
+}
+
+func (e WorkerExecutor) RunStream(ctx context.Context, deviceID, message string, onOutput func([]byte)) (string, error) {
+	log.Printf("[executor] start worker request session_id=%s", deviceID)
+	req := workerpool.Request{SessionID: deviceID, Message: message, Args: optionArgsFrom(ctx)}
+	if claims := callerClaims(ctx); claims != nil {
+		req.Tenant = claims.Tenant
+		req.Subject = claims.Subject
+	}
+
+	var onChunk func(string)
+	if onOutput != nil {
+		onChunk = func(chunk string) { onOutput([]byte(chunk)) }
+	}
+	output, err := e.Pool.Do(ctx, req, onChunk)
+	if err != nil {
+		log.Printf("[executor] worker request failed session_id=%s err=%v", deviceID, err)
+		return output, err
+	}
+
+	log.Printf("[executor] worker request finished session_id=%s output_bytes=%d", deviceID, len(output))
+	return output, nil
+}
+
+// updateWorkerMetrics exports the size and worker counts of every pool in the
+// server's executor chains.
+func (s *Server) updateWorkerMetrics() {
+	s.walkExecutors(func(e CommandExecutor) {
+		w, ok := e.(WorkerExecutor)
+		if !ok {
+			return
+		}
+		stats := w.Pool.Stats()
+		s.metrics.Set("clawproxy_workers", float64(stats.Workers-stats.Idle), "pool", w.Name, "state", "busy")
+		s.metrics.Set("clawproxy_workers", float64(stats.Idle), "pool", w.Name, "state", "idle")
+		for event, count := range map[string]int{"spawned": stats.Spawned, "recycled": stats.Recycled, "crashed": stats.Crashed, "stopped": stats.Stopped} {
+			s.metrics.Set("clawproxy_worker_events_total", float64(count), "pool", w.Name, "event", event)
+		}
+	})
+}
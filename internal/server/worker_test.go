@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"clawproxy/internal/workerpool"
+)
+
+func TestServer_WorkerPoolMetrics(t *testing.T) {
+	pool, err := workerpool.New(workerpool.Config{Binary: "sh", Args: []string{"-c", "cat >/dev/null"}, Min: 1})
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatalf("start pool: %v", err)
+	}
+	defer pool.Close()
+
+	srv := NewWithExecutor(":0", testJWTSecret, FallbackExecutor{Primary: &fakeExecutor{}, Fallback: WorkerExecutor{Name: "fallback", Pool: pool}})
+	w := doJSON(t, srv.Engine(), http.MethodGet, "/metrics", mustCreateAdminToken(t), nil)
+	for _, want := range []string{
+		`clawproxy_workers{pool="fallback",state="idle"} 1`,
+		`clawproxy_workers{pool="fallback",state="busy"} 0`,
+		`clawproxy_worker_events_total{event="spawned",pool="fallback"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("expected %s in metrics, got %s", want, w.Body.String())
+		}
+	}
+}
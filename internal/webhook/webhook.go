@@ -0,0 +1,264 @@
+// Package webhook delivers signed JSON payloads to HTTP endpoints, retrying
+// with exponential backoff and keeping dead letters for inspection.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers set on every delivery.
+const (
+	HeaderSignature = "X-Clawproxy-Signature"
+	HeaderTimestamp = "X-Clawproxy-Timestamp"
+	HeaderDelivery  = "X-Clawproxy-Delivery"
+	HeaderEvent     = "X-Clawproxy-Event"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+var ErrNotFound = errors.New("delivery not found")
+
+type Config struct {
+	// MaxAttempts before a delivery becomes a dead letter.
+	MaxAttempts int
+	// BaseDelay is the first retry delay; each further retry doubles it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds a single attempt.
+	Timeout time.Duration
+	// MaxDeadLetters caps how many dead letters are kept; the oldest go first.
+	MaxDeadLetters int
+}
+
+var DefaultConfig = Config{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Minute, Timeout: 10 * time.Second, MaxDeadLetters: 1000}
+
+type Delivery struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       string    `json:"event"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+
+	body   []byte
+	secret []byte
+}
+
+// Dispatcher delivers payloads in the background. Pending deliveries and dead
+// letters live in memory; delivered ones are forgotten.
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+
+	// Observe, when set, is called with the status after every attempt:
+	// delivered, pending (will retry) or dead.
+	Observe func(status string)
+
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func NewDispatcher(cfg Config) *Dispatcher {
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		// Redirects are not followed: they would re-send the signed body to a
+		// host nobody allowed. A 3xx fails the attempt like any other non-2xx.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &Dispatcher{cfg: cfg, client: client, deliveries: make(map[string]*Delivery)}
+}
+
+// Sign returns the signature header value for body sent at timestamp:
+// "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Enqueue schedules body for delivery to url and returns immediately.
+func (d *Dispatcher) Enqueue(url, event string, body, secret []byte) (Delivery, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return Delivery{}, fmt.Errorf("generate delivery id: %w", err)
+	}
+
+	delivery := &Delivery{
+		ID:        base64.RawURLEncoding.EncodeToString(raw),
+		URL:       url,
+		Event:     event,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+		body:      body,
+		secret:    secret,
+	}
+
+	d.mu.Lock()
+	d.deliveries[delivery.ID] = delivery
+	snapshot := *delivery
+	d.mu.Unlock()
+
+	go d.deliver(delivery)
+	return snapshot, nil
+}
+
+// List returns pending deliveries and dead letters, oldest first.
+func (d *Dispatcher) List() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]Delivery, 0, len(d.deliveries))
+	for _, delivery := range d.deliveries {
+		list = append(list, *delivery)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Retry schedules a dead letter for delivery again with a fresh attempt count.
+func (d *Dispatcher) Retry(id string) (Delivery, error) {
+	d.mu.Lock()
+	delivery, ok := d.deliveries[id]
+	if !ok || delivery.Status != StatusDead {
+		d.mu.Unlock()
+		return Delivery{}, ErrNotFound
+	}
+	delivery.Status = StatusPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Time{}
+	snapshot := *delivery
+	d.mu.Unlock()
+
+	go d.deliver(delivery)
+	return snapshot, nil
+}
+
+// Discard removes a dead letter.
+func (d *Dispatcher) Discard(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery, ok := d.deliveries[id]
+	if !ok || delivery.Status != StatusDead {
+		return ErrNotFound
+	}
+	delete(d.deliveries, id)
+	return nil
+}
+
+func (d *Dispatcher) deliver(delivery *Delivery) {
+	for {
+		err := d.attempt(delivery)
+
+		d.mu.Lock()
+		delivery.Attempts++
+		status := StatusDelivered
+		var wait time.Duration
+		switch {
+		case err == nil:
+			delete(d.deliveries, delivery.ID)
+		case delivery.Attempts >= d.cfg.MaxAttempts:
+			status = StatusDead
+			delivery.Status = StatusDead
+			delivery.LastError = err.Error()
+			delivery.NextAttempt = time.Time{}
+			d.pruneDeadLocked()
+		default:
+			status = StatusPending
+			wait = d.backoff(delivery.Attempts)
+			delivery.LastError = err.Error()
+			delivery.NextAttempt = time.Now().Add(wait)
+		}
+		d.mu.Unlock()
+
+		if d.Observe != nil {
+			d.Observe(status)
+		}
+		if status != StatusPending {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (d *Dispatcher) attempt(delivery *Delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return fmt.Errorf("build webhook request: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.secret, timestamp, delivery.body))
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderEvent, delivery.Event)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.BaseDelay
+	for i := 1; i < attempts && wait < d.cfg.MaxDelay; i++ {
+		wait *= 2
+	}
+	if wait > d.cfg.MaxDelay {
+		wait = d.cfg.MaxDelay
+	}
+
+	return wait
+}
+
+func (d *Dispatcher) pruneDeadLocked() {
+	var dead []*Delivery
+	for _, delivery := range d.deliveries {
+		if delivery.Status == StatusDead {
+			dead = append(dead, delivery)
+		}
+	}
+	if len(dead) <= d.cfg.MaxDeadLetters {
+		return
+	}
+
+	sort.Slice(dead, func(i, j int) bool { return dead[i].CreatedAt.Before(dead[j].CreatedAt) })
+	for _, delivery := range dead[:len(dead)-d.cfg.MaxDeadLetters] {
+		delete(d.deliveries, delivery.ID)
+	}
+}
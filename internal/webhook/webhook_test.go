@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond, Timeout: time.Second, MaxDeadLetters: 10}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcherSignsAndRetries(t *testing.T) {
+	secret := []byte("hook-secret")
+	var calls atomic.Int32
+	var verified atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if r.Header.Get(HeaderSignature) == Sign(secret, timestamp, body) && string(body) == `{"ok":true}` {
+			verified.Store(true)
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(testConfig)
+	if _, err := d.Enqueue(ts.URL, "message.completed", []byte(`{"ok":true}`), secret); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	waitFor(t, func() bool { return calls.Load() == 2 && len(d.List()) == 0 })
+	if !verified.Load() {
+		t.Fatal("expected a correctly signed delivery")
+	}
+}
+
+func TestDispatcherDeadLetterAndRetry(t *testing.T) {
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(testConfig)
+	delivery, err := d.Enqueue(ts.URL, "message.completed", []byte(`{}`), []byte("s"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		list := d.List()
+		return len(list) == 1 && list[0].Status == StatusDead
+	})
+	if got := calls.Load(); got != int32(testConfig.MaxAttempts) {
+		t.Fatalf("expected %d attempts, got %d", testConfig.MaxAttempts, got)
+	}
+	if list := d.List(); list[0].Attempts != testConfig.MaxAttempts || list[0].LastError == "" {
+		t.Fatalf("unexpected dead letter: %+v", list[0])
+	}
+
+	healthy.Store(true)
+	if _, err := d.Retry(delivery.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	waitFor(t, func() bool { return len(d.List()) == 0 })
+
+	if _, err := d.Retry(delivery.ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for delivered id, got %v", err)
+	}
+}
+
+func TestDispatcherDoesNotFollowRedirects(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	}))
+	defer target.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(testConfig)
+	if _, err := d.Enqueue(ts.URL, "message.completed", []byte(`{}`), []byte("s")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		list := d.List()
+		return len(list) == 1 && list[0].Status == StatusDead
+	})
+	if got := redirected.Load(); got != 0 {
+		t.Fatalf("expected the redirect not to be followed, target got %d posts", got)
+	}
+	if list := d.List(); list[0].LastError != "webhook returned status 307" {
+		t.Fatalf("expected the redirect to fail the delivery, got %q", list[0].LastError)
+	}
+}
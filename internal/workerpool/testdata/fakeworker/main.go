@@ -0,0 +1,57 @@
+// Command fakeworker speaks the worker protocol for the pool's tests. The
+// message picks its behaviour: "crash" exits without answering, "fail"
+// answers with an error, "chunks" streams two chunks, "sleep" never answers
+// and "slow" answers after 200ms. Anything else is echoed back with the
+// worker's pid and request count.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type request struct {
+	ID        string   `json:"id"`
+	SessionID string   `json:"sessionId"`
+	Message   string   `json:"message"`
+	Args      []string `json:"args"`
+}
+
+func main() {
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 1<<20), 16<<20)
+
+	count := 0
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "bad request: %v\n", err)
+			os.Exit(2)
+		}
+		count++
+
+		switch req.Message {
+		case "crash":
+			os.Exit(1)
+		case "fail":
+			out.Encode(map[string]any{"id": req.ID, "done": true, "error": "model unavailable"})
+		case "chunks":
+			out.Encode(map[string]any{"id": req.ID, "chunk": "thinking..."})
+			out.Encode(map[string]any{"id": req.ID, "chunk": `{"reply":"hi"}`})
+			out.Encode(map[string]any{"id": req.ID, "done": true})
+		case "sleep":
+			out.Encode(map[string]any{"id": req.ID, "chunk": "partial"})
+			time.Sleep(time.Hour)
+		default:
+			if req.Message == "slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			reply, _ := json.Marshal(map[string]any{"pid": os.Getpid(), "count": count, "session": req.SessionID, "message": req.Message, "args": req.Args})
+			out.Encode(map[string]any{"id": req.ID, "done": true, "output": string(reply)})
+		}
+	}
+}
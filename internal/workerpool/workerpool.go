@@ -0,0 +1,498 @@
+// Package workerpool keeps long-lived worker processes that answer requests
+// over a line-delimited JSON protocol on stdin and stdout.
+//
+// Each request is one line:
+//
+//	{"id":"7","sessionId":"dev-1","message":"hello","args":["--model","x"]}
+//
+// and the worker answers with any number of chunk lines followed by a final
+// line with done set:
+//
+//	{"id":"7","chunk":"thinking..."}
+//	{"id":"7","done":true,"output":"{\"reply\":\"hi\"}"}
+//	{"id":"7","done":true,"error":"model unavailable"}
+//
+// A worker handles one request at a time. Anything else on stdout, or the
+// worker exiting, counts as a crash.
+package workerpool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("worker pool closed")
+
+// stopTimeout is how long a worker has to exit after its stdin is closed.
+const stopTimeout = 5 * time.Second
+
+type Config struct {
+	Binary  string   `json:"binary"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	WorkDir string   `json:"workDir,omitempty"`
+	// Min workers are started up front and replaced when they exit.
+	Min int `json:"min,omitempty"`
+	// Max bounds concurrent workers; requests wait for one to free up.
+	// Zero means Min, or one when Min is zero too.
+	Max int `json:"max,omitempty"`
+	// MaxRequests recycles a worker after that many requests; zero never does.
+	MaxRequests int `json:"maxRequests,omitempty"`
+	// IdleSeconds stops workers above Min that sat idle that long; zero
+	// keeps them.
+	IdleSeconds int `json:"idleSeconds,omitempty"`
+}
+
+func (c Config) Validate() error {
+	if c.Binary == "" {
+		return fmt.Errorf("workers: binary is required")
+	}
+	if c.Min < 0 || c.Max < 0 || c.MaxRequests < 0 || c.IdleSeconds < 0 {
+		return fmt.Errorf("workers: sizes and limits must not be negative")
+	}
+	if c.Max > 0 && c.Min > c.Max {
+		return fmt.Errorf("workers: min %d exceeds max %d", c.Min, c.Max)
+	}
+
+	return nil
+}
+
+func (c Config) max() int {
+	if c.Max > 0 {
+		return c.Max
+	}
+	if c.Min > 0 {
+		return c.Min
+	}
+
+	return 1
+}
+
+type Request struct {
+	ID        string   `json:"id"`
+	SessionID string   `json:"sessionId"`
+	Message   string   `json:"message"`
+	Args      []string `json:"args,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+}
+
+type Response struct {
+	ID     string `json:"id"`
+	Chunk  string `json:"chunk,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Stats is a snapshot of the pool's size, and counts of workers spawned,
+// recycled after MaxRequests, crashed and stopped for being idle since the
+// pool was created.
+type Stats struct {
+	Workers  int `json:"workers"`
+	Idle     int `json:"idle"`
+	Spawned  int `json:"spawned"`
+	Recycled int `json:"recycled"`
+	Crashed  int `json:"crashed"`
+	Stopped  int `json:"stopped"`
+}
+
+// Pool routes requests to idle workers, starting new ones up to Max.
+type Pool struct {
+	cfg Config
+
+	mu      sync.Mutex
+	idle    []*worker
+	total   int
+	nextID  uint64
+	closed  bool
+	changed chan struct{}
+	done    chan struct{}
+	stats   Stats
+}
+
+func New(cfg Config) (*Pool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Pool{cfg: cfg, changed: make(chan struct{}), done: make(chan struct{})}, nil
+}
+
+// Start warms up Min workers and begins stopping idle ones. Requests also
+// start workers on demand, so Start is optional.
+func (p *Pool) Start() error {
+	for i := 0; i < p.cfg.Min; i++ {
+		p.mu.Lock()
+		p.total++
+		p.mu.Unlock()
+
+		w, err := p.spawn()
+		if err != nil {
+			p.mu.Lock()
+			p.total--
+			p.mu.Unlock()
+			return err
+		}
+		p.put(w)
+	}
+
+	if p.cfg.IdleSeconds > 0 {
+		go p.reapIdle(time.Duration(p.cfg.IdleSeconds) * time.Second)
+	}
+
+	return nil
+}
+
+// Close stops every idle worker; busy ones stop when their request ends.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.total -= len(idle)
+	close(p.done)
+	p.broadcastLocked()
+	p.mu.Unlock()
+
+	for _, w := range idle {
+		w.stop()
+	}
+
+	return nil
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Workers, stats.Idle = p.total, len(p.idle)
+	return stats
+}
+
+// Do sends req to a worker and returns its output. Chunks are passed to
+// onChunk as they arrive. When ctx ends first the worker is killed and the
+// chunks received so far are returned with ctx's error.
+func (p *Pool) Do(ctx context.Context, req Request, onChunk func(string)) (string, error) {
+	w, err := p.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	req.ID = strconv.FormatUint(p.nextID, 10)
+	p.mu.Unlock()
+
+	type result struct {
+		output string
+		broken bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, broken, err := w.roundTrip(req, onChunk)
+		done <- result{output: output, broken: broken, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.broken {
+			p.discard(w, &p.stats.Crashed)
+		} else {
+			p.release(w)
+		}
+		return r.output, r.err
+	case <-ctx.Done():
+		w.kill()
+		r := <-done
+		p.discard(w, nil)
+		return r.output, ctx.Err()
+	}
+}
+
+func (p *Pool) acquire(ctx context.Context) (*worker, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrClosed
+		}
+		for len(p.idle) > 0 {
+			w := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if !w.exitedEarly() {
+				p.mu.Unlock()
+				return w, nil
+			}
+			p.total--
+			p.stats.Crashed++
+			w.stop()
+		}
+		if p.total < p.cfg.max() {
+			p.total++
+			p.mu.Unlock()
+
+			w, err := p.spawn()
+			if err != nil {
+				p.mu.Lock()
+				p.total--
+				p.broadcastLocked()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return w, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release returns a healthy worker to the idle list, or recycles it once it
+// has served MaxRequests.
+func (p *Pool) release(w *worker) {
+	w.served++
+	if p.cfg.MaxRequests > 0 && w.served >= p.cfg.MaxRequests {
+		p.discard(w, &p.stats.Recycled)
+		return
+	}
+	p.put(w)
+}
+
+func (p *Pool) put(w *worker) {
+	w.idleSince = time.Now()
+
+	p.mu.Lock()
+	if p.closed {
+		p.total--
+		p.mu.Unlock()
+		w.stop()
+		return
+	}
+	p.idle = append(p.idle, w)
+	p.broadcastLocked()
+	p.mu.Unlock()
+}
+
+// discard stops w and starts a replacement when the pool fell below Min.
+// count, when set, is the Stats counter to bump.
+func (p *Pool) discard(w *worker, count *int) {
+	w.stop()
+
+	p.mu.Lock()
+	p.total--
+	if count != nil {
+		*count++
+	}
+	refill := !p.closed && p.total < p.cfg.Min
+	if refill {
+		p.total++
+	}
+	p.broadcastLocked()
+	p.mu.Unlock()
+
+	if refill {
+		go func() {
+			w, err := p.spawn()
+			if err != nil {
+				p.mu.Lock()
+				p.total--
+				p.broadcastLocked()
+				p.mu.Unlock()
+				return
+			}
+			p.put(w)
+		}()
+	}
+}
+
+func (p *Pool) reapIdle(idleFor time.Duration) {
+	ticker := time.NewTicker(idleFor / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		var stale []*worker
+		p.mu.Lock()
+		// The idle list is used LIFO, so the longest idle workers are first.
+		for len(p.idle) > 0 && p.total > p.cfg.Min && time.Since(p.idle[0].idleSince) >= idleFor {
+			stale = append(stale, p.idle[0])
+			p.idle = p.idle[1:]
+			p.total--
+			p.stats.Stopped++
+		}
+		p.mu.Unlock()
+
+		for _, w := range stale {
+			w.stop()
+		}
+	}
+}
+
+func (p *Pool) broadcastLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Pool) spawn() (*worker, error) {
+	cmd := exec.Command(p.cfg.Binary, p.cfg.Args...)
+	if len(p.cfg.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.cfg.Env...)
+	}
+	cmd.Dir = p.cfg.WorkDir
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("worker stdin: %w", err)
+	}
+	// A plain pipe instead of StdoutPipe, so Wait never closes it before the
+	// last response has been read.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("worker stdout: %w", err)
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrLog(filepath.Base(p.cfg.Binary))
+
+	if err := cmd.Start(); err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, fmt.Errorf("start worker %s: %w", p.cfg.Binary, err)
+	}
+	stdoutW.Close()
+
+	w := &worker{cmd: cmd, stdin: stdin, stdout: stdoutR, reader: bufio.NewReader(stdoutR), exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("[workerpool] worker exited pid=%d err=%v", cmd.Process.Pid, err)
+		close(w.exited)
+	}()
+
+	log.Printf("[workerpool] worker started pid=%d", cmd.Process.Pid)
+	p.mu.Lock()
+	p.stats.Spawned++
+	p.mu.Unlock()
+	return w, nil
+}
+
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	reader *bufio.Reader
+	exited chan struct{}
+
+	served    int
+	idleSince time.Time
+	stopOnce  sync.Once
+}
+
+// roundTrip writes one request and reads until its final response. broken
+// reports that the worker can no longer be trusted with requests.
+func (w *worker) roundTrip(req Request, onChunk func(string)) (string, bool, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return "", false, fmt.Errorf("encode worker request: %w", err)
+	}
+	if _, err := w.stdin.Write(append(line, '\n')); err != nil {
+		return "", true, fmt.Errorf("write worker request: %w", err)
+	}
+
+	var chunks strings.Builder
+	for {
+		line, err := w.reader.ReadBytes('\n')
+		if err != nil {
+			return chunks.String(), true, fmt.Errorf("worker exited: %w", err)
+		}
+
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil || resp.ID != req.ID {
+			return chunks.String(), true, fmt.Errorf("worker protocol error: unexpected line %q", strings.TrimSpace(string(line)))
+		}
+		if !resp.Done {
+			chunks.WriteString(resp.Chunk)
+			if onChunk != nil && resp.Chunk != "" {
+				onChunk(resp.Chunk)
+			}
+			continue
+		}
+		if resp.Error != "" {
+			return chunks.String(), false, fmt.Errorf("worker: %s", resp.Error)
+		}
+		if resp.Output == "" {
+			return chunks.String(), false, nil
+		}
+		return resp.Output, false, nil
+	}
+}
+
+func (w *worker) exitedEarly() bool {
+	select {
+	case <-w.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop closes stdin, which tells the worker to exit, and kills it when it
+// does not within stopTimeout.
+func (w *worker) stop() {
+	w.stopOnce.Do(func() {
+		w.stdin.Close()
+		go func() {
+			select {
+			case <-w.exited:
+			case <-time.After(stopTimeout):
+				w.kill()
+				<-w.exited
+			}
+			w.stdout.Close()
+		}()
+	})
+}
+
+func (w *worker) kill() {
+	if err := w.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Printf("[workerpool] kill worker failed pid=%d err=%v", w.cmd.Process.Pid, err)
+	}
+}
+
+// stderrLog logs a worker's stderr line by line.
+type stderrLog string
+
+func (name stderrLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Printf("[workerpool] %s stderr: %s", string(name), line)
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,206 @@
+package workerpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWorker is the testdata/fakeworker binary, built once for the package.
+var fakeWorker string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fakeworker")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fakeWorker = filepath.Join(dir, "fakeworker")
+	if out, err := exec.Command("go", "build", "-o", fakeWorker, "./testdata/fakeworker").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "build fake worker: %v\n%s", err, out)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type echo struct {
+	PID     int      `json:"pid"`
+	Count   int      `json:"count"`
+	Session string   `json:"session"`
+	Message string   `json:"message"`
+	Args    []string `json:"args"`
+}
+
+func newPool(t *testing.T, cfg Config) *Pool {
+	t.Helper()
+	cfg.Binary = fakeWorker
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("start pool: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func do(t *testing.T, p *Pool, message string) echo {
+	t.Helper()
+	out, err := p.Do(context.Background(), Request{SessionID: "dev-1", Message: message, Args: []string{"--model", "x"}}, nil)
+	if err != nil {
+		t.Fatalf("do %q: %v", message, err)
+	}
+	var e echo
+	if err := json.Unmarshal([]byte(out), &e); err != nil {
+		t.Fatalf("decode output %q: %v", out, err)
+	}
+
+	return e
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolReusesWarmWorker(t *testing.T) {
+	p := newPool(t, Config{Min: 1, Max: 2})
+	if stats := p.Stats(); stats.Workers != 1 || stats.Idle != 1 {
+		t.Fatalf("expected one warm worker, got %+v", stats)
+	}
+
+	first := do(t, p, "hello")
+	second := do(t, p, "world")
+	if first.PID != second.PID || second.Count != 2 {
+		t.Fatalf("expected the warm worker to serve both requests, got %+v then %+v", first, second)
+	}
+	if second.Session != "dev-1" || second.Message != "world" || strings.Join(second.Args, " ") != "--model x" {
+		t.Fatalf("unexpected request seen by worker: %+v", second)
+	}
+}
+
+func TestPoolRecyclesAfterMaxRequests(t *testing.T) {
+	p := newPool(t, Config{Min: 1, Max: 1, MaxRequests: 2})
+
+	first := do(t, p, "a")
+	second := do(t, p, "b")
+	third := do(t, p, "c")
+	if first.PID != second.PID || third.PID == second.PID || third.Count != 1 {
+		t.Fatalf("expected a fresh worker after two requests, got pids %d %d %d", first.PID, second.PID, third.PID)
+	}
+	if stats := p.Stats(); stats.Recycled != 1 {
+		t.Fatalf("expected one recycled worker, got %+v", stats)
+	}
+}
+
+func TestPoolReplacesCrashedWorker(t *testing.T) {
+	p := newPool(t, Config{Min: 1, Max: 1})
+
+	before := do(t, p, "hello")
+	if _, err := p.Do(context.Background(), Request{Message: "crash"}, nil); err == nil {
+		t.Fatal("expected the crash to fail the request")
+	}
+	after := do(t, p, "hello")
+	if after.PID == before.PID {
+		t.Fatal("expected the crashed worker to be replaced")
+	}
+	if stats := p.Stats(); stats.Crashed != 1 || stats.Spawned != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolWorkerErrorKeepsWorker(t *testing.T) {
+	p := newPool(t, Config{Min: 1})
+
+	before := do(t, p, "hello")
+	if _, err := p.Do(context.Background(), Request{Message: "fail"}, nil); err == nil || !strings.Contains(err.Error(), "model unavailable") {
+		t.Fatalf("expected the worker's error, got %v", err)
+	}
+	if after := do(t, p, "hello"); after.PID != before.PID {
+		t.Fatal("expected a reported error to keep the worker")
+	}
+}
+
+func TestPoolStreamsChunks(t *testing.T) {
+	p := newPool(t, Config{})
+
+	var chunks []string
+	out, err := p.Do(context.Background(), Request{Message: "chunks"}, func(chunk string) { chunks = append(chunks, chunk) })
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if out != `thinking...{"reply":"hi"}` || len(chunks) != 2 {
+		t.Fatalf("unexpected output %q chunks %q", out, chunks)
+	}
+}
+
+func TestPoolCancelKillsWorker(t *testing.T) {
+	p := newPool(t, Config{Max: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	out, err := p.Do(ctx, Request{Message: "sleep"}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || out != "partial" {
+		t.Fatalf("expected deadline error with partial output, got %q %v", out, err)
+	}
+	do(t, p, "hello")
+}
+
+func TestPoolScalesBetweenMinAndMax(t *testing.T) {
+	p := newPool(t, Config{Min: 1, Max: 3, IdleSeconds: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Do(context.Background(), Request{Message: "slow"}, nil); err != nil {
+				t.Errorf("do: %v", err)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return p.Stats().Workers == 3 })
+	wg.Wait()
+	if stats := p.Stats(); stats.Workers != 3 || stats.Idle != 3 {
+		t.Fatalf("expected three idle workers at most, got %+v", stats)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for p.Stats().Workers > 1 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if stats := p.Stats(); stats.Workers != 1 || stats.Stopped != 2 {
+		t.Fatalf("expected idle workers to scale down to min, got %+v", stats)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Binary: "openclaw", Min: 3, Max: 2},
+		{Binary: "openclaw", MaxRequests: -1},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+}